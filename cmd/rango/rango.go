@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"crypto"
 	"crypto/ed25519"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"math/rand"
@@ -17,6 +23,7 @@ import (
 
 	"github.com/openware/pkg/jwt"
 	"github.com/openware/rango/pkg/amqp"
+	"github.com/openware/rango/pkg/auth"
 	"github.com/openware/rango/pkg/metrics"
 	"github.com/openware/rango/pkg/routing"
 )
@@ -26,6 +33,7 @@ var (
 	amqpAddr = flag.String("amqp-addr", "", "AMQP server address")
 	pubKey   = flag.String("pubKey", "config/ed25519-key.pub", "Path to public key")
 	exName   = flag.String("exchange", "peatio.events.ranger", "Exchange name of upstream messages")
+	dryRun   = flag.Bool("routing-dry-run", false, "Print the events of the routing keys given as arguments (or on stdin) and exit")
 )
 
 const prefix = "Bearer "
@@ -41,9 +49,44 @@ func token(r *http.Request) string {
 	return authHeader[len(prefix):]
 }
 
-func authHandler(h httpHanlder, key ed25519.PublicKey, mustAuth bool) httpHanlder {
+// jwtValidator returns the identity of the tokens verified by the key store.
+func jwtValidator(ks *auth.KeyStore) routing.TokenValidator {
+	return func(token string) (routing.Auth, error) {
+		claims, err := ks.ParseAndValidate(token)
+		if err != nil {
+			return routing.Auth{}, err
+		}
+
+		res := routing.Auth{UID: claims.UID, Role: claims.Role}
+		if claims.ExpiresAt != 0 {
+			res.ExpiresAt = time.Unix(claims.ExpiresAt, 0)
+		}
+		return res, nil
+	}
+}
+
+type authenticator func(r *http.Request) (routing.Auth, error)
+
+// requestAuth returns the identity of the requests signed by an API key, if
+// apiKeys is set, or of their JWT otherwise.
+func requestAuth(validate routing.TokenValidator, apiKeys *auth.HMACVerifier) authenticator {
+	return func(r *http.Request) (routing.Auth, error) {
+		if apiKeys == nil || !auth.Signed(r.Header) {
+			return validate(token(r))
+		}
+
+		key, err := apiKeys.Verify(r.Header)
+		if err != nil {
+			log.Info().Msgf("API key authentication failed: %s", err.Error())
+			return routing.Auth{}, err
+		}
+		return routing.Auth{UID: key.UID, Role: key.Role}, nil
+	}
+}
+
+func authHandler(h httpHanlder, authenticate authenticator, mustAuth bool) httpHanlder {
 	return func(w http.ResponseWriter, r *http.Request) {
-		auth, err := jwt.ParseAndValidateEdDSA(token(r), key)
+		auth, err := authenticate(r)
 
 		if err != nil && mustAuth {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -53,15 +96,107 @@ func authHandler(h httpHanlder, key ed25519.PublicKey, mustAuth bool) httpHanlde
 		if err == nil {
 			r.Header.Set("JwtUID", auth.UID)
 			r.Header.Set("JwtRole", auth.Role)
+			if auth.ExpiresAt.IsZero() {
+				r.Header.Del("JwtExpiresAt")
+			} else {
+				r.Header.Set("JwtExpiresAt", strconv.FormatInt(auth.ExpiresAt.Unix(), 10))
+			}
 		} else {
 			r.Header.Del("JwtUID")
 			r.Header.Del("JwtRole")
+			r.Header.Del("JwtExpiresAt")
 		}
 		h(w, r)
 		return
 	}
 }
 
+// getTokenExpiry returns the enforcement of the token expiry configured by
+// RANGO_TOKEN_EXPIRY_ACTION and RANGO_TOKEN_EXPIRY_WARNING, nil when disabled.
+func getTokenExpiry() (*routing.TokenExpiry, error) {
+	warning, err := time.ParseDuration(getEnv("RANGO_TOKEN_EXPIRY_WARNING", "1m"))
+	if err != nil {
+		return nil, err
+	}
+
+	switch action := getEnv("RANGO_TOKEN_EXPIRY_ACTION", "none"); action {
+	case "close":
+		return routing.NewTokenExpiry(warning, true), nil
+	case "unsubscribe":
+		return routing.NewTokenExpiry(warning, false), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown token expiry action: %s", action)
+	}
+}
+
+// getKeyStore returns the keys verifying the JWTs, loaded from the JWKS file
+// or directory RANGO_JWKS_PATH, or the Ed25519 public key of Ranger.
+func getKeyStore() (*auth.KeyStore, error) {
+	var ks *auth.KeyStore
+
+	if path := os.Getenv("RANGO_JWKS_PATH"); path != "" {
+		var err error
+		ks, err = auth.LoadKeyStore(path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		pub, err := getPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		ks = auth.NewKeyStore(map[string]crypto.PublicKey{"": pub})
+	}
+
+	ks.Issuer = os.Getenv("RANGO_JWT_ISSUER")
+	ks.Audience = os.Getenv("RANGO_JWT_AUDIENCE")
+	return ks, nil
+}
+
+// watchKeyStore reloads the JWKS files when they change or on SIGHUP.
+func watchKeyStore(ks *auth.KeyStore) error {
+	if os.Getenv("RANGO_JWKS_PATH") == "" {
+		return nil
+	}
+
+	interval, err := time.ParseDuration(getEnv("RANGO_JWKS_RELOAD_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("invalid RANGO_JWKS_RELOAD_INTERVAL")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go ks.Watch(interval, hup, func(err error) {
+		log.Error().Msgf("Reloading JWKS failed: %s", err.Error())
+	})
+	return nil
+}
+
+// getAPIKeys returns the verifier of the requests signed by the API keys of
+// the RANGO_API_KEYS file, nil if not set.
+func getAPIKeys() (*auth.HMACVerifier, error) {
+	path := os.Getenv("RANGO_API_KEYS")
+	if path == "" {
+		return nil, nil
+	}
+
+	keys, err := auth.LoadAPIKeys(path)
+	if err != nil {
+		return nil, err
+	}
+
+	skew, err := time.ParseDuration(getEnv("RANGO_API_KEY_CLOCK_SKEW", "30s"))
+	if err != nil || skew <= 0 {
+		return nil, fmt.Errorf("invalid RANGO_API_KEY_CLOCK_SKEW")
+	}
+
+	log.Info().Msgf("Loaded %d API keys", keys.Len())
+	return auth.NewHMACVerifier(keys, skew), nil
+}
+
 func setupLogger() {
 	logLevel, ok := os.LookupEnv("LOG_LEVEL")
 	if ok {
@@ -125,6 +260,113 @@ func getServerAddress() string {
 	return fmt.Sprintf("%s:%s", host, port)
 }
 
+func getSnapshotRequester(p routing.Publisher) (*routing.SnapshotRequester, error) {
+	routingKey := os.Getenv("RANGO_SNAPSHOT_REQUEST_ROUTING_KEY")
+	if routingKey == "" {
+		return nil, nil
+	}
+
+	interval, err := time.ParseDuration(getEnv("RANGO_SNAPSHOT_REQUEST_INTERVAL", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RANGO_SNAPSHOT_REQUEST_INTERVAL: %w", err)
+	}
+
+	exchange := getEnv("RANGO_SNAPSHOT_REQUEST_EXCHANGE", *exName)
+	return routing.NewSnapshotRequester(p, exchange, routingKey, interval), nil
+}
+
+func getLastValueCache() (*routing.LastValueCache, error) {
+	types := os.Getenv("RANGO_LAST_VALUE_TYPES")
+	if types == "" {
+		return nil, nil
+	}
+
+	ttl, err := time.ParseDuration(getEnv("RANGO_LAST_VALUE_TTL", "24h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RANGO_LAST_VALUE_TTL: %w", err)
+	}
+
+	return routing.NewLastValueCache(strings.Split(types, ","), ttl), nil
+}
+
+func getHistory() (*routing.History, error) {
+	config := os.Getenv("RANGO_HISTORY_SIZES")
+	if config == "" {
+		return nil, nil
+	}
+
+	sizes := make(map[string]int)
+	for _, rec := range strings.Split(config, ",") {
+		kv := strings.Split(rec, "=")
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid RANGO_HISTORY_SIZES entry %q", rec)
+		}
+
+		size, err := strconv.Atoi(kv[1])
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid RANGO_HISTORY_SIZES entry %q", rec)
+		}
+		sizes[kv[0]] = size
+	}
+
+	return routing.NewHistory(sizes), nil
+}
+
+func getSessions() (*routing.Sessions, error) {
+	grace := os.Getenv("RANGO_SESSION_GRACE")
+	if grace == "" {
+		return nil, nil
+	}
+
+	d, err := time.ParseDuration(grace)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid RANGO_SESSION_GRACE %q", grace)
+	}
+
+	size, err := strconv.Atoi(getEnv("RANGO_SESSION_BUFFER", "1000"))
+	if err != nil || size <= 0 {
+		return nil, fmt.Errorf("invalid RANGO_SESSION_BUFFER")
+	}
+
+	return routing.NewSessions(d, size), nil
+}
+
+func getRoutingRules() (*routing.RoutingRules, error) {
+	path := os.Getenv("RANGO_ROUTING_RULES")
+	if path == "" {
+		return nil, nil
+	}
+
+	return routing.LoadRoutingRules(path)
+}
+
+// routingDryRun prints the event each routing key is mapped to.
+func routingDryRun(rules *routing.RoutingRules, keys []string, w io.Writer) {
+	if rules == nil {
+		rules, _ = routing.NewRoutingRules(nil)
+	}
+
+	for _, key := range keys {
+		msg, err := rules.Map(key)
+		if err != nil {
+			fmt.Fprintf(w, "%s -> error: %s\n", key, err.Error())
+			continue
+		}
+		fmt.Fprintf(w, "%s -> scope=%s stream=%s type=%s topic=%s\n", key, msg.Scope, msg.Stream, msg.Type, msg.Topic)
+	}
+}
+
+func readLines(r io.Reader) []string {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func getRBACConfig() map[string][]string {
 	envs := os.Environ()
 
@@ -164,16 +406,83 @@ func main() {
 
 	setupLogger()
 
+	routingRules, err := getRoutingRules()
+	if err != nil {
+		log.Fatal().Msgf("routing rules init failed: %s", err.Error())
+		return
+	}
+
+	if *dryRun {
+		keys := flag.Args()
+		if len(keys) == 0 {
+			keys = readLines(os.Stdin)
+		}
+		routingDryRun(routingRules, keys, os.Stdout)
+		return
+	}
+
 	metrics.Enable()
 
 	rbac := getRBACConfig()
 	hub := routing.NewHub(rbac)
-	pub, err := getPublicKey()
+	hub.RoutingRules = routingRules
+
+	lastValues, err := getLastValueCache()
 	if err != nil {
-		log.Error().Msgf("Loading public key failed: %s", err.Error())
+		log.Fatal().Msgf("last value cache init failed: %s", err.Error())
+		return
+	}
+	hub.LastValues = lastValues
+
+	history, err := getHistory()
+	if err != nil {
+		log.Fatal().Msgf("history init failed: %s", err.Error())
+		return
+	}
+	hub.History = history
+
+	sessions, err := getSessions()
+	if err != nil {
+		log.Fatal().Msgf("sessions init failed: %s", err.Error())
+		return
+	}
+	hub.Sessions = sessions
+
+	hub.SlowConsumerPolicy, err = routing.NewSlowConsumerPolicy(os.Getenv("RANGO_SLOW_CONSUMER_POLICY"))
+	if err != nil {
+		log.Fatal().Msgf("slow consumer policy init failed: %s", err.Error())
+		return
+	}
+
+	hub.MaxBatchSize, err = strconv.Atoi(getEnv("RANGO_BATCH_MAX_SIZE", "65536"))
+	if err != nil || hub.MaxBatchSize < 0 {
+		log.Fatal().Msgf("invalid RANGO_BATCH_MAX_SIZE")
+		return
+	}
+
+	hub.RevokeRoutingKey = getEnv("RANGO_REVOKE_ROUTING_KEY", "system.session.revoke")
+	hub.RoleRoutingKey = getEnv("RANGO_ROLE_ROUTING_KEY", "system.session.role")
+
+	hub.TokenExpiry, err = getTokenExpiry()
+	if err != nil {
+		log.Fatal().Msgf("token expiry init failed: %s", err.Error())
+		return
+	}
+
+	ks, err := getKeyStore()
+	if err != nil {
+		log.Error().Msgf("Loading public keys failed: %s", err.Error())
 		time.Sleep(2 * time.Second)
 		return
 	}
+	if err := watchKeyStore(ks); err != nil {
+		log.Fatal().Msgf(err.Error())
+		return
+	}
+	log.Info().Msgf("Loaded %d public keys", ks.Len())
+
+	validate := jwtValidator(ks)
+	hub.ValidateToken = validate
 
 	rand.Seed(time.Now().UnixNano())
 	globalQName := fmt.Sprintf("rango.instance.%d", rand.Int())
@@ -185,6 +494,12 @@ func main() {
 		log.Fatal().Msgf("creating new AMQP session failed: %s", err.Error())
 		return
 	}
+	hub.SnapshotRequester, err = getSnapshotRequester(globalMq)
+	if err != nil {
+		log.Fatal().Msgf("snapshot requests init failed: %s", err.Error())
+		return
+	}
+
 	err = globalMq.Stream(*exName, globalQName, "#", hub.SkipPrivateMsg)
 	defer globalMq.Close(globalQName)
 
@@ -207,15 +522,29 @@ func main() {
 		return
 	}
 
+	privateTTL, err := time.ParseDuration(getEnv("RANGO_PRIVATE_SNAPSHOT_TTL", "10m"))
+	if err != nil || privateTTL <= 0 {
+		log.Fatal().Msgf("invalid RANGO_PRIVATE_SNAPSHOT_TTL")
+		return
+	}
+
 	go hub.ListenWebsocketEvents()
+	go hub.ExpirePrivateObjects(privateTTL)
 
 	wsHandler := func(w http.ResponseWriter, r *http.Request) {
 		routing.NewClient(hub, w, r)
 	}
 
-	http.HandleFunc("/private", authHandler(wsHandler, pub, true))
-	http.HandleFunc("/public", authHandler(wsHandler, pub, false))
-	http.HandleFunc("/", authHandler(wsHandler, pub, false))
+	apiKeys, err := getAPIKeys()
+	if err != nil {
+		log.Fatal().Msgf("API keys init failed: %s", err.Error())
+		return
+	}
+	authenticate := requestAuth(validate, apiKeys)
+
+	http.HandleFunc("/private", authHandler(wsHandler, authenticate, true))
+	http.HandleFunc("/public", authHandler(wsHandler, authenticate, false))
+	http.HandleFunc("/", authHandler(wsHandler, authenticate, false))
 
 	go http.ListenAndServe(":4242", promhttp.Handler())
 
@@ -1,9 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/openware/pkg/jwt"
+	"github.com/openware/rango/pkg/auth"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRango_envToMatrix(t *testing.T) {
@@ -20,3 +34,180 @@ func TestRango_envToMatrix(t *testing.T) {
 	assert.Equal(t, []string{"TWO", "three", "four"}, matrix["one"])
 	assert.Equal(t, "bar", matrix["foo"][0])
 }
+
+func TestRango_getHistory(t *testing.T) {
+	t.Setenv("RANGO_HISTORY_SIZES", "")
+	h, err := getHistory()
+	assert.NoError(t, err)
+	assert.Nil(t, h)
+
+	t.Setenv("RANGO_HISTORY_SIZES", "trades=100,kline-*=50")
+	h, err = getHistory()
+	assert.NoError(t, err)
+	assert.NotNil(t, h)
+
+	for _, config := range []string{"trades", "trades=abc", "trades=0"} {
+		t.Setenv("RANGO_HISTORY_SIZES", config)
+		_, err = getHistory()
+		assert.Error(t, err, config)
+	}
+}
+
+func TestRango_routingDryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.yml")
+	err := os.WriteFile(path, []byte(`
+rules:
+  - pattern: '(?P<scope>private)\.(?P<stream>[^.]+)\.(?P<type>[^.]+)\.[^.]+'
+`), 0600)
+	assert.NoError(t, err)
+
+	t.Setenv("RANGO_ROUTING_RULES", path)
+	rules, err := getRoutingRules()
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	routingDryRun(rules, readLines(strings.NewReader("private.UID.order.created\n\npublic.eurusd.trades\nbad\n")), &out)
+	assert.Equal(t, `private.UID.order.created -> scope=private stream=UID type=order topic=order
+public.eurusd.trades -> scope=public stream=eurusd type=trades topic=eurusd.trades
+bad -> error: Bad routing key: bad
+`, out.String())
+
+	t.Setenv("RANGO_ROUTING_RULES", filepath.Join(t.TempDir(), "missing.yml"))
+	_, err = getRoutingRules()
+	assert.Error(t, err)
+}
+
+func TestRango_getTokenExpiry(t *testing.T) {
+	// The expiry is not enforced by default
+	expiry, err := getTokenExpiry()
+	require.NoError(t, err)
+	assert.Nil(t, expiry)
+
+	t.Setenv("RANGO_TOKEN_EXPIRY_ACTION", "close")
+	expiry, err = getTokenExpiry()
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, expiry.Warning)
+	assert.True(t, expiry.Close)
+
+	t.Setenv("RANGO_TOKEN_EXPIRY_ACTION", "unsubscribe")
+	t.Setenv("RANGO_TOKEN_EXPIRY_WARNING", "30s")
+	expiry, err = getTokenExpiry()
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, expiry.Warning)
+	assert.False(t, expiry.Close)
+
+	t.Setenv("RANGO_TOKEN_EXPIRY_ACTION", "ignore")
+	_, err = getTokenExpiry()
+	assert.EqualError(t, err, "unknown token expiry action: ignore")
+}
+
+func TestRango_getKeyStore(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	jwks := `{"keys":[{"kty":"OKP","crv":"Ed25519","x":"` + base64.RawURLEncoding.EncodeToString(pub) + `"}]}`
+	require.NoError(t, os.WriteFile(path, []byte(jwks), 0644))
+
+	t.Setenv("RANGO_JWKS_PATH", path)
+	t.Setenv("RANGO_JWT_ISSUER", "barong")
+	t.Setenv("RANGO_JWT_AUDIENCE", "peatio")
+	ks, err := getKeyStore()
+	require.NoError(t, err)
+	assert.Equal(t, 1, ks.Len())
+
+	token, err := jwt.ForgeTokenEdDSA("UID123", "user@example.com", "admin", 3, 0, priv, nil)
+	require.NoError(t, err)
+	_, err = ks.ParseAndValidate(token)
+	assert.NoError(t, err)
+
+	t.Setenv("RANGO_JWT_AUDIENCE", "applogic")
+	ks, err = getKeyStore()
+	require.NoError(t, err)
+	_, err = ks.ParseAndValidate(token)
+	assert.EqualError(t, err, "invalid audience")
+
+	t.Setenv("RANGO_JWKS_PATH", filepath.Join(t.TempDir(), "missing.json"))
+	_, err = getKeyStore()
+	assert.Error(t, err)
+}
+
+func TestRango_jwtValidator(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	validate := jwtValidator(auth.NewKeyStore(map[string]crypto.PublicKey{"": pub}))
+
+	token, err := jwt.ForgeTokenEdDSA("UID123", "user@example.com", "admin", 3, 0, priv, nil)
+	require.NoError(t, err)
+	auth, err := validate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "UID123", auth.UID)
+	assert.Equal(t, "admin", auth.Role)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), auth.ExpiresAt, time.Minute)
+
+	token, err = jwt.ForgeTokenEdDSA("UID123", "user@example.com", "admin", 3, 0, other, nil)
+	require.NoError(t, err)
+	_, err = validate(token)
+	assert.Error(t, err)
+
+	_, err = validate("")
+	assert.Error(t, err)
+}
+
+func TestRango_authHandler(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	validate := jwtValidator(auth.NewKeyStore(map[string]crypto.PublicKey{"": pub}))
+
+	path := filepath.Join(t.TempDir(), "api_keys.yml")
+	require.NoError(t, os.WriteFile(path, []byte("keys:\n  - access_key: bot\n    secret_key: secret\n    uid: UID456\n    role: trader\n"), 0644))
+	t.Setenv("RANGO_API_KEYS", path)
+	apiKeys, err := getAPIKeys()
+	require.NoError(t, err)
+
+	var uid, role string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		uid, role = r.Header.Get("JwtUID"), r.Header.Get("JwtRole")
+	}
+	private := authHandler(handler, requestAuth(validate, apiKeys), true)
+	public := authHandler(handler, requestAuth(validate, apiKeys), false)
+
+	serve := func(h httpHanlder, header http.Header) int {
+		uid, role = "", ""
+		r := httptest.NewRequest("GET", "/", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	token, err := jwt.ForgeTokenEdDSA("UID123", "user@example.com", "admin", 3, 0, priv, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve(private, http.Header{"Authorization": {"Bearer " + token}}))
+	assert.Equal(t, []string{"UID123", "admin"}, []string{uid, role})
+
+	signer := auth.NewAPIKeyHMAC("bot", "secret")
+	signed := signer.GetSignedHeader(0)
+	assert.Equal(t, http.StatusOK, serve(private, signed))
+	assert.Equal(t, []string{"UID456", "trader"}, []string{uid, role})
+
+	// A replayed request is rejected
+	assert.Equal(t, http.StatusUnauthorized, serve(private, signed))
+	assert.Equal(t, http.StatusOK, serve(public, signed))
+	assert.Equal(t, []string{"", ""}, []string{uid, role})
+
+	forged := auth.NewAPIKeyHMAC("bot", "guess").GetSignedHeader(0)
+	assert.Equal(t, http.StatusUnauthorized, serve(private, forged))
+
+	// The API keys are not accepted when not configured
+	assert.Equal(t, http.StatusUnauthorized, serve(authHandler(handler, requestAuth(validate, nil), true), signer.GetSignedHeader(0)))
+
+	t.Setenv("RANGO_API_KEY_CLOCK_SKEW", "soon")
+	_, err = getAPIKeys()
+	assert.EqualError(t, err, "invalid RANGO_API_KEY_CLOCK_SKEW")
+}
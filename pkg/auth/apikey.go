@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// APIKey is an API key of a user, its secret signs the requests.
+type APIKey struct {
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	UID       string `yaml:"uid"`
+	Role      string `yaml:"role"`
+}
+
+// APIKeyStore returns the API keys by access key.
+type APIKeyStore interface {
+	Get(accessKey string) (*APIKey, bool)
+}
+
+// FileAPIKeyStore is an APIKeyStore loaded from a YAML file.
+type FileAPIKeyStore struct {
+	keys map[string]*APIKey
+}
+
+type apiKeysConfig struct {
+	Keys []*APIKey `yaml:"keys"`
+}
+
+// LoadAPIKeys reads the API keys of a YAML file:
+//
+//	keys:
+//	  - access_key: 61d025b8573501c2
+//	    secret_key: 2d0b4979c7fe6986daa8e21d1dc0644f
+//	    uid: UID123
+//	    role: trader
+func LoadAPIKeys(path string) (*FileAPIKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config apiKeysConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	ks := &FileAPIKeyStore{keys: make(map[string]*APIKey, len(config.Keys))}
+	for i, k := range config.Keys {
+		if k.AccessKey == "" || k.SecretKey == "" || k.UID == "" {
+			return nil, fmt.Errorf("API key %d: missing access_key, secret_key or uid", i)
+		}
+		if _, ok := ks.keys[k.AccessKey]; ok {
+			return nil, fmt.Errorf("API key %d: duplicate access key %s", i, k.AccessKey)
+		}
+		ks.keys[k.AccessKey] = k
+	}
+	return ks, nil
+}
+
+func (ks *FileAPIKeyStore) Get(accessKey string) (*APIKey, bool) {
+	k, ok := ks.keys[accessKey]
+	return k, ok
+}
+
+// Len returns the number of keys.
+func (ks *FileAPIKeyStore) Len() int {
+	return len(ks.keys)
+}
+
+// HMACVerifier authenticates the requests signed by an API key with the
+// X-Auth-Apikey, X-Auth-Nonce and X-Auth-Signature headers of APIKeyHMAC.
+// The nonce is a timestamp in milliseconds, it must be within the clock skew
+// window and cannot be used twice.
+type HMACVerifier struct {
+	keys APIKeyStore
+	skew time.Duration
+
+	// map[access key:nonce -> time after which the nonce is outside of the
+	// window] of the nonces used
+	nonces    map[string]time.Time
+	lastPurge time.Time
+	mutex     sync.Mutex
+}
+
+func NewHMACVerifier(keys APIKeyStore, skew time.Duration) *HMACVerifier {
+	return &HMACVerifier{
+		keys:   keys,
+		skew:   skew,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Signed reports whether the request carries an API key.
+func Signed(header http.Header) bool {
+	return header.Get("X-Auth-Apikey") != ""
+}
+
+// Verify returns the API key which signed the request.
+func (v *HMACVerifier) Verify(header http.Header) (*APIKey, error) {
+	accessKey := header.Get("X-Auth-Apikey")
+	signature := header.Get("X-Auth-Signature")
+	nonce, err := strconv.ParseInt(header.Get("X-Auth-Nonce"), 10, 64)
+	if accessKey == "" || signature == "" || err != nil {
+		return nil, errors.New("missing or invalid API key headers")
+	}
+
+	now := time.Now()
+	at := time.Unix(0, nonce*int64(time.Millisecond))
+	if at.Before(now.Add(-v.skew)) || at.After(now.Add(v.skew)) {
+		return nil, errors.New("nonce is outside of the clock skew window")
+	}
+
+	key, ok := v.keys.Get(accessKey)
+	if !ok {
+		return nil, errors.New("unknown API key")
+	}
+
+	expected := NewAPIKeyHMAC(key.AccessKey, key.SecretKey).GetSignature(nonce)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	if !v.useNonce(accessKey, nonce, at.Add(v.skew), now) {
+		return nil, errors.New("nonce already used")
+	}
+	return key, nil
+}
+
+// useNonce records the nonce of an access key, false if it was used before.
+func (v *HMACVerifier) useNonce(accessKey string, nonce int64, expires, now time.Time) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	// The nonces outside of the window are rejected anyway
+	if now.Sub(v.lastPurge) >= v.skew {
+		for n, t := range v.nonces {
+			if now.After(t) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastPurge = now
+	}
+
+	k := accessKey + ":" + strconv.FormatInt(nonce, 10)
+	if _, ok := v.nonces[k]; ok {
+		return false
+	}
+	v.nonces[k] = expires
+	return true
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const apiKeysYAML = `
+keys:
+  - access_key: 61d025b8573501c2
+    secret_key: 2d0b4979c7fe6986daa8e21d1dc0644f
+    uid: UID123
+    role: trader
+`
+
+func loadTestAPIKeys(t *testing.T, content string) (*FileAPIKeyStore, error) {
+	path := filepath.Join(t.TempDir(), "api_keys.yml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return LoadAPIKeys(path)
+}
+
+func nowNonce() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	ks, err := loadTestAPIKeys(t, apiKeysYAML)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ks.Len())
+
+	k, ok := ks.Get("61d025b8573501c2")
+	require.True(t, ok)
+	assert.Equal(t, &APIKey{"61d025b8573501c2", "2d0b4979c7fe6986daa8e21d1dc0644f", "UID123", "trader"}, k)
+
+	_, ok = ks.Get("unknown")
+	assert.False(t, ok)
+
+	_, err = loadTestAPIKeys(t, "keys:\n  - access_key: abc\n    secret_key: def\n")
+	assert.EqualError(t, err, "API key 0: missing access_key, secret_key or uid")
+
+	_, err = loadTestAPIKeys(t, apiKeysYAML+"  - access_key: 61d025b8573501c2\n    secret_key: abc\n    uid: UID456\n")
+	assert.EqualError(t, err, "API key 1: duplicate access key 61d025b8573501c2")
+
+	_, err = LoadAPIKeys(filepath.Join(t.TempDir(), "missing.yml"))
+	assert.Error(t, err)
+}
+
+func TestHMACVerifier(t *testing.T) {
+	ks, err := loadTestAPIKeys(t, apiKeysYAML)
+	require.NoError(t, err)
+	v := NewHMACVerifier(ks, 30*time.Second)
+	signer := NewAPIKeyHMAC("61d025b8573501c2", "2d0b4979c7fe6986daa8e21d1dc0644f")
+
+	header := signer.GetSignedHeader(0)
+	assert.True(t, Signed(header))
+	key, err := v.Verify(header)
+	require.NoError(t, err)
+	assert.Equal(t, "UID123", key.UID)
+	assert.Equal(t, "trader", key.Role)
+
+	t.Run("nonces cannot be replayed", func(t *testing.T) {
+		_, err := v.Verify(header)
+		assert.EqualError(t, err, "nonce already used")
+
+		// The nonces of other keys are independent
+		other := NewAPIKeyHMAC("unknown", "secret").GetSignedHeader(nowNonce())
+		_, err = v.Verify(other)
+		assert.EqualError(t, err, "unknown API key")
+	})
+
+	t.Run("nonces must be within the clock skew", func(t *testing.T) {
+		for _, nonce := range []int64{nowNonce() - 60000, nowNonce() + 60000, 1584524005143} {
+			_, err := v.Verify(signer.GetSignedHeader(nonce))
+			assert.EqualError(t, err, "nonce is outside of the clock skew window", nonce)
+		}
+
+		_, err := v.Verify(signer.GetSignedHeader(nowNonce() - 20000))
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid signatures do not use the nonce", func(t *testing.T) {
+		nonce := nowNonce() + 1000
+		forged := NewAPIKeyHMAC("61d025b8573501c2", "wrong").GetSignedHeader(nonce)
+		_, err := v.Verify(forged)
+		assert.EqualError(t, err, "invalid signature")
+
+		_, err = v.Verify(signer.GetSignedHeader(nonce))
+		assert.NoError(t, err)
+	})
+
+	t.Run("missing headers", func(t *testing.T) {
+		assert.False(t, Signed(http.Header{}))
+
+		for _, name := range []string{"X-Auth-Apikey", "X-Auth-Nonce", "X-Auth-Signature"} {
+			h := signer.GetSignedHeader(nowNonce() + 2000)
+			h.Del(name)
+			_, err := v.Verify(h)
+			assert.EqualError(t, err, "missing or invalid API key headers", name)
+		}
+
+		h := signer.GetSignedHeader(0)
+		h.Set("X-Auth-Nonce", "now")
+		_, err := v.Verify(h)
+		assert.EqualError(t, err, "missing or invalid API key headers")
+	})
+
+	t.Run("used nonces are purged once outside of the window", func(t *testing.T) {
+		v := NewHMACVerifier(ks, 50*time.Millisecond)
+		_, err := v.Verify(signer.GetSignedHeader(nowNonce()))
+		require.NoError(t, err)
+		assert.Len(t, v.nonces, 1)
+
+		time.Sleep(120 * time.Millisecond)
+		nonce := nowNonce()
+		_, err = v.Verify(signer.GetSignedHeader(nonce))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"61d025b8573501c2:" + strconv.FormatInt(nonce, 10)}, nonceKeys(v))
+	})
+}
+
+func nonceKeys(v *HMACVerifier) []string {
+	keys := []string{}
+	for k := range v.nonces {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	gojwt "github.com/golang-jwt/jwt"
+	"github.com/openware/pkg/jwt"
+)
+
+// KeyStore holds the public keys verifying the JWTs, selected by the kid
+// header of the tokens. The tokens without kid are verified by the key
+// without kid, if any. A static store of a single key verifies all the
+// tokens whatever their kid, like the Ed25519 key of Ranger.
+//
+// RS256, ES256 and EdDSA signatures are supported, the algorithm of a token
+// must match the type of its key.
+type KeyStore struct {
+	// Issuer of the tokens, not checked when empty
+	Issuer string
+
+	// Audience the tokens must be intended for, not checked when empty
+	Audience string
+
+	// JWKS file or directory of JWKS files, empty for a static key store
+	path string
+
+	// Files and modification times of the keys loaded
+	version string
+
+	keys  map[string]crypto.PublicKey
+	mutex sync.RWMutex
+}
+
+// NewKeyStore returns a key store of the given keys by kid.
+func NewKeyStore(keys map[string]crypto.PublicKey) *KeyStore {
+	return &KeyStore{keys: keys}
+}
+
+// LoadKeyStore returns a key store of the keys of a JWKS file, or of the
+// .json files of a directory.
+func LoadKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{path: path}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload reads the JWKS files again, the keys are kept if they are invalid.
+func (ks *KeyStore) Reload() error {
+	if ks.path == "" {
+		return nil
+	}
+
+	files, version, err := jwksFiles(ks.path)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, f := range files {
+		if err := loadJWKS(f, keys); err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	ks.keys = keys
+	ks.version = version
+	return nil
+}
+
+// Watch reloads the keys when the JWKS files change, checked at each
+// interval, and each time a signal is received on reload. Errors are
+// reported to the callback, the previous keys are kept.
+func (ks *KeyStore) Watch(interval time.Duration, reload <-chan os.Signal, failed func(error)) {
+	if ks.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, version, err := jwksFiles(ks.path)
+			if err == nil && version == ks.loaded() {
+				continue
+			}
+			if err == nil {
+				err = ks.Reload()
+			}
+			if err != nil {
+				failed(err)
+			}
+
+		case _, ok := <-reload:
+			if !ok {
+				return
+			}
+			if err := ks.Reload(); err != nil {
+				failed(err)
+			}
+		}
+	}
+}
+
+func (ks *KeyStore) loaded() string {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	return ks.version
+}
+
+// Len returns the number of keys.
+func (ks *KeyStore) Len() int {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	return len(ks.keys)
+}
+
+// ParseAndValidate parses the token and validates its signature, issuer and
+// audience.
+func (ks *KeyStore) ParseAndValidate(token string) (jwt.Auth, error) {
+	auth := jwt.Auth{}
+
+	_, err := gojwt.ParseWithClaims(token, &auth, ks.key)
+	if err != nil {
+		return auth, err
+	}
+
+	if ks.Issuer != "" && auth.Issuer != ks.Issuer {
+		return auth, fmt.Errorf("invalid issuer: %s", auth.Issuer)
+	}
+	if ks.Audience != "" && !contains(auth.Audience, ks.Audience) {
+		return auth, errors.New("invalid audience")
+	}
+	return auth, nil
+}
+
+// key returns the key of a token, if its algorithm matches the key type.
+func (ks *KeyStore) key(t *gojwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	ks.mutex.RLock()
+	key, ok := ks.keys[kid]
+	if !ok && ks.path == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			key, ok = k, true
+		}
+	}
+	ks.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+
+	var alg string
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		alg = gojwt.SigningMethodRS256.Alg()
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			alg = gojwt.SigningMethodES256.Alg()
+		}
+	case ed25519.PublicKey:
+		alg = gojwt.SigningMethodEdDSA.Alg()
+	}
+
+	if t.Method.Alg() != alg {
+		return nil, fmt.Errorf("unexpected signing method %s for key %s", t.Method.Alg(), kid)
+	}
+	return key, nil
+}
+
+// jwksFiles returns the JWKS files of the path and their version, which
+// changes when a file is added, removed or modified.
+func jwksFiles(path string) ([]string, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, "", err
+		}
+		sort.Strings(files)
+	}
+
+	version := ""
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, "", err
+		}
+		version += fmt.Sprintf("%s:%d:%d;", f, info.ModTime().UnixNano(), info.Size())
+	}
+	return files, version, nil
+}
+
+// jwk is a JSON Web Key, only the public keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKS adds the signing keys of a JWKS file to keys.
+func loadJWKS(path string, keys map[string]crypto.PublicKey) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return err
+	}
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if _, ok := keys[k.Kid]; ok {
+			return fmt.Errorf("duplicate key id: %s", k.Kid)
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("key %s: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gojwt "github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func publicJWK(kid string, key crypto.PublicKey) map[string]string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(k.X.Bytes()), "y": b64(k.Y.Bytes())}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(k)}
+	}
+	panic("unsupported key")
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	b, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0644))
+}
+
+func signToken(t *testing.T, method gojwt.SigningMethod, kid string, key crypto.PrivateKey, claims gojwt.MapClaims) string {
+	all := gojwt.MapClaims{
+		"uid":  "UID123",
+		"role": "admin",
+		"iss":  "barong",
+		"aud":  []string{"peatio", "barong"},
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	token := gojwt.NewWithClaims(method, all)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
+
+func TestKeyStoreAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path,
+		publicJWK("rsa", &rsaKey.PublicKey),
+		publicJWK("ec", &ecKey.PublicKey),
+		publicJWK("ed", edPub),
+		map[string]string{"kty": "oct", "kid": "enc", "use": "enc"},
+	)
+
+	ks, err := LoadKeyStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, ks.Len())
+
+	for _, tc := range []struct {
+		method gojwt.SigningMethod
+		kid    string
+		key    crypto.PrivateKey
+	}{
+		{gojwt.SigningMethodRS256, "rsa", rsaKey},
+		{gojwt.SigningMethodES256, "ec", ecKey},
+		{gojwt.SigningMethodEdDSA, "ed", edKey},
+	} {
+		auth, err := ks.ParseAndValidate(signToken(t, tc.method, tc.kid, tc.key, nil))
+		require.NoError(t, err, tc.kid)
+		assert.Equal(t, "UID123", auth.UID)
+		assert.Equal(t, "admin", auth.Role)
+	}
+
+	t.Run("the key is selected by kid", func(t *testing.T) {
+		_, err := ks.ParseAndValidate(signToken(t, gojwt.SigningMethodRS256, "other", rsaKey, nil))
+		assert.EqualError(t, err, "unknown key id: other")
+
+		_, err = ks.ParseAndValidate(signToken(t, gojwt.SigningMethodRS256, "", rsaKey, nil))
+		assert.EqualError(t, err, "unknown key id: ")
+
+		_, err = ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "ed", ed25519.NewKeyFromSeed(make([]byte, 32)), nil))
+		assert.Error(t, err)
+	})
+
+	t.Run("the algorithm must match the key", func(t *testing.T) {
+		_, err := ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "rsa", edKey, nil))
+		assert.EqualError(t, err, "unexpected signing method EdDSA for key rsa")
+
+		_, err = ks.ParseAndValidate(signToken(t, gojwt.SigningMethodHS256, "ed", []byte(edPub), nil))
+		assert.EqualError(t, err, "unexpected signing method HS256 for key ed")
+	})
+
+	t.Run("issuer and audience", func(t *testing.T) {
+		ks.Issuer = "barong"
+		ks.Audience = "peatio"
+		defer func() { ks.Issuer, ks.Audience = "", "" }()
+
+		_, err := ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "ed", edKey, nil))
+		assert.NoError(t, err)
+
+		_, err = ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "ed", edKey, gojwt.MapClaims{"iss": "other"}))
+		assert.EqualError(t, err, "invalid issuer: other")
+
+		_, err = ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "ed", edKey, gojwt.MapClaims{"aud": []string{"applogic"}}))
+		assert.EqualError(t, err, "invalid audience")
+	})
+
+	t.Run("expired tokens are rejected", func(t *testing.T) {
+		_, err := ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "ed", edKey, gojwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}))
+		assert.Error(t, err)
+	})
+}
+
+func TestKeyStoreStatic(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	ks := NewKeyStore(map[string]crypto.PublicKey{"": pub})
+	assert.NoError(t, ks.Reload())
+
+	auth, err := ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "", key, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "UID123", auth.UID)
+
+	// The single key of a static store verifies the tokens with a kid
+	auth, err = ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "2024-01", key, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "UID123", auth.UID)
+
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = ks.ParseAndValidate(signToken(t, gojwt.SigningMethodEdDSA, "2024-01", other, nil))
+	assert.Error(t, err)
+}
+
+func TestKeyStoreInvalid(t *testing.T) {
+	dir := t.TempDir()
+	_, err := LoadKeyStore(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+
+	for name, key := range map[string]map[string]string{
+		"key k1: unsupported key type: oct": {"kty": "oct", "kid": "k1"},
+		"key k1: unsupported curve: P-384":  {"kty": "EC", "kid": "k1", "crv": "P-384"},
+		"key k1: point is not on the curve": {"kty": "EC", "kid": "k1", "crv": "P-256", "x": "AQ", "y": "AQ"},
+		"key k1: invalid Ed25519 key size":  {"kty": "OKP", "kid": "k1", "crv": "Ed25519", "x": "AQ"},
+		"key k1: missing key parameter":     {"kty": "RSA", "kid": "k1", "e": "AQAB"},
+		"key k1: invalid RSA exponent":      {"kty": "RSA", "kid": "k1", "n": "AQAB", "e": "AQ"},
+	} {
+		path := filepath.Join(dir, "jwks.json")
+		writeJWKS(t, path, key)
+		_, err := LoadKeyStore(path)
+		assert.EqualError(t, err, path+": "+name)
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	writeJWKS(t, filepath.Join(dir, "a.json"), publicJWK("k1", pub))
+	writeJWKS(t, filepath.Join(dir, "b.json"), publicJWK("k1", pub))
+	os.Remove(filepath.Join(dir, "jwks.json"))
+	_, err = LoadKeyStore(dir)
+	assert.EqualError(t, err, filepath.Join(dir, "b.json")+": duplicate key id: k1")
+}
+
+func TestKeyStoreRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldPub, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	newPub, newKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	writeJWKS(t, filepath.Join(dir, "old.json"), publicJWK("old", oldPub))
+	ks, err := LoadKeyStore(dir)
+	require.NoError(t, err)
+
+	oldToken := signToken(t, gojwt.SigningMethodEdDSA, "old", oldKey, nil)
+	newToken := signToken(t, gojwt.SigningMethodEdDSA, "new", newKey, nil)
+	_, err = ks.ParseAndValidate(newToken)
+	assert.Error(t, err)
+
+	reload := make(chan os.Signal)
+	errs := make(chan error, 10)
+	done := make(chan struct{})
+	go func() {
+		ks.Watch(10*time.Millisecond, reload, func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+		close(done)
+	}()
+
+	// A new file is picked up on change
+	writeJWKS(t, filepath.Join(dir, "new.json"), publicJWK("new", newPub))
+	require.Eventually(t, func() bool {
+		_, err := ks.ParseAndValidate(newToken)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	_, err = ks.ParseAndValidate(oldToken)
+	assert.NoError(t, err)
+
+	// The keys are kept when the files are invalid
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "new.json"), []byte("{"), 0644))
+	assert.Error(t, <-errs)
+	_, err = ks.ParseAndValidate(newToken)
+	assert.NoError(t, err)
+
+	// The old key is retired
+	require.NoError(t, os.Remove(filepath.Join(dir, "old.json")))
+	writeJWKS(t, filepath.Join(dir, "new.json"), publicJWK("new", newPub))
+	require.Eventually(t, func() bool {
+		_, err := ks.ParseAndValidate(oldToken)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// A signal reloads the keys
+	ks.mutex.Lock()
+	ks.keys = nil
+	ks.mutex.Unlock()
+	reload <- os.Interrupt
+	assert.Eventually(t, func() bool {
+		_, err := ks.ParseAndValidate(newToken)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	close(reload)
+	<-done
+}
@@ -7,6 +7,12 @@ import (
 type Request struct {
 	Method  string
 	Streams []string
+
+	// Number of past messages to receive when subscribing
+	History int
+
+	// JWT of the auth requests
+	Token string
 }
 
 func PackOutgoingResponse(err error, message interface{}) ([]byte, error) {
@@ -19,7 +25,23 @@ func PackOutgoingResponse(err error, message interface{}) ([]byte, error) {
 	return json.Marshal(res)
 }
 
+// PackOutgoingEvent returns the {channel: data} message, raw JSON data is
+// copied without being encoded again.
 func PackOutgoingEvent(channel string, data interface{}) ([]byte, error) {
+	if raw, ok := data.(json.RawMessage); ok && len(raw) > 0 {
+		name, err := json.Marshal(channel)
+		if err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, 0, len(name)+len(raw)+3)
+		b = append(b, '{')
+		b = append(b, name...)
+		b = append(b, ':')
+		b = append(b, raw...)
+		return append(b, '}'), nil
+	}
+
 	resp := make(map[string]interface{}, 1)
 	resp[channel] = data
 	return json.Marshal(resp)
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"testing"
@@ -46,3 +47,15 @@ func TestMsg_Event(t *testing.T) {
 		t.Fatal("Event invalid")
 	}
 }
+
+func TestMsg_RawEvent(t *testing.T) {
+	res, err := PackOutgoingEvent(`eurusd."trades"`, json.RawMessage(`[{"tid":1,"price":"1.0"}]`))
+
+	if err != nil {
+		t.Fatal("Should not return error")
+	}
+
+	if string(res) != `{"eurusd.\"trades\"":[{"tid":1,"price":"1.0"}]}` {
+		t.Fatal("Event invalid", string(res))
+	}
+}
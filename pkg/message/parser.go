@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 )
 
 func ParseRequest(msg []byte) (Request, error) {
@@ -19,6 +20,7 @@ func ParseRequest(msg []byte) (Request, error) {
 func Parse(msg []byte) (Request, error) {
 	var v map[string]interface{}
 	var parsed Request
+	var err error
 
 	if err := json.Unmarshal(msg, &v); err != nil {
 		return parsed, fmt.Errorf("Could not parse message: %w", err)
@@ -31,12 +33,16 @@ func Parse(msg []byte) (Request, error) {
 		if !ok {
 			return parsed, fmt.Errorf("No streams provided")
 		}
-		switch reflect.TypeOf(streams).Kind() {
-		case reflect.Slice:
-			streams := reflect.ValueOf(v["streams"])
-			for i := 0; i < streams.Len(); i++ {
-				parsed.Streams = append(parsed.Streams, streams.Index(i).Interface().(string))
+		parsed.Streams, err = parseStreams(streams)
+		if err != nil {
+			return parsed, err
+		}
+		if history, ok := v["history"]; ok {
+			n, ok := history.(float64)
+			if !ok || n < 0 || n != float64(int(n)) {
+				return parsed, errors.New("Could not parse history: invalid number")
 			}
+			parsed.History = int(n)
 		}
 	case "unsubscribe":
 		parsed.Method = "unsubscribe"
@@ -44,16 +50,63 @@ func Parse(msg []byte) (Request, error) {
 		if !ok {
 			return parsed, fmt.Errorf("No streams provided")
 		}
-		switch reflect.TypeOf(streams).Kind() {
-		case reflect.Slice:
-			streams := reflect.ValueOf(v["streams"])
-			for i := 0; i < streams.Len(); i++ {
-				parsed.Streams = append(parsed.Streams, streams.Index(i).Interface().(string))
-			}
+		parsed.Streams, err = parseStreams(streams)
+		if err != nil {
+			return parsed, err
+		}
+	case "auth", "refresh":
+		parsed.Method = v["event"].(string)
+		token, ok := v["token"].(string)
+		if !ok || token == "" {
+			return parsed, errors.New("No token provided")
 		}
+		parsed.Token = token
 	default:
 		return parsed, errors.New("Could not parse Type: Invalid event")
 	}
 
 	return parsed, nil
 }
+
+// parseStreams returns the names of the streams of a request. A stream is
+// either a name or an object with options, {"stream":"eurusd.ob-inc",
+// "throttle_ms":250} is the same stream as "eurusd.ob-inc@250ms".
+func parseStreams(streams interface{}) ([]string, error) {
+	var names []string
+
+	if t := reflect.TypeOf(streams); t == nil || t.Kind() != reflect.Slice {
+		return names, nil
+	}
+
+	list := reflect.ValueOf(streams)
+	for i := 0; i < list.Len(); i++ {
+		switch s := list.Index(i).Interface().(type) {
+		case string:
+			names = append(names, s)
+
+		case map[string]interface{}:
+			name, ok := s["stream"].(string)
+			if !ok || name == "" {
+				return nil, errors.New("Could not parse stream: missing name")
+			}
+
+			if throttle, ok := s["throttle_ms"]; ok {
+				ms, ok := throttle.(float64)
+				if !ok || ms <= 0 || ms != float64(int64(ms)) {
+					return nil, fmt.Errorf("Could not parse stream %s: invalid throttle_ms", name)
+				}
+				name += "@" + strconv.FormatInt(int64(ms), 10) + "ms"
+			}
+			names = append(names, name)
+
+		default:
+			return nil, fmt.Errorf("Could not parse stream: %v", s)
+		}
+
+		if _, err := ParseStreamName(names[len(names)-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,81 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse_Streams(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"subscribe","streams":["global.tickers@1s",{"stream":"eurusd.ob-inc","throttle_ms":250},{"stream":"eurusd.trades"}]}`))
+	if err != nil {
+		t.Fatal("Should not return error", err)
+	}
+
+	expected := []string{"global.tickers@1s", "eurusd.ob-inc@250ms", "eurusd.trades"}
+	if req.Method != "subscribe" || !reflect.DeepEqual(req.Streams, expected) {
+		t.Fatalf("Request invalid: %v", req)
+	}
+
+	for _, msg := range []string{
+		`{"event":"subscribe","streams":[{"throttle_ms":250}]}`,
+		`{"event":"subscribe","streams":[{"stream":"eurusd.ob-inc","throttle_ms":"250"}]}`,
+		`{"event":"subscribe","streams":[{"stream":"eurusd.ob-inc","throttle_ms":-1}]}`,
+		`{"event":"unsubscribe","streams":[42]}`,
+	} {
+		if _, err := Parse([]byte(msg)); err == nil {
+			t.Fatal("Should return error", msg)
+		}
+	}
+}
+
+func TestParse_History(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"subscribe","streams":["eurusd.trades"],"history":50}`))
+	if err != nil {
+		t.Fatal("Should not return error", err)
+	}
+
+	if req.History != 50 {
+		t.Fatalf("History invalid: %d", req.History)
+	}
+
+	for _, msg := range []string{
+		`{"event":"subscribe","streams":["eurusd.trades"],"history":-1}`,
+		`{"event":"subscribe","streams":["eurusd.trades"],"history":"50"}`,
+		`{"event":"subscribe","streams":["eurusd.trades"],"history":1.5}`,
+	} {
+		if _, err := Parse([]byte(msg)); err == nil {
+			t.Fatal("Should return error", msg)
+		}
+	}
+}
+
+func TestParse_Auth(t *testing.T) {
+	req, err := Parse([]byte(`{"event":"auth","token":"header.payload.signature"}`))
+	if err != nil {
+		t.Fatal("Should not return error", err)
+	}
+
+	if req.Method != "auth" || req.Token != "header.payload.signature" {
+		t.Fatalf("Request invalid: %v", req)
+	}
+
+	req, err = Parse([]byte(`{"event":"refresh","token":"header.payload.signature"}`))
+	if err != nil {
+		t.Fatal("Should not return error", err)
+	}
+
+	if req.Method != "refresh" || req.Token != "header.payload.signature" {
+		t.Fatalf("Request invalid: %v", req)
+	}
+
+	for _, msg := range []string{
+		`{"event":"auth"}`,
+		`{"event":"refresh"}`,
+		`{"event":"auth","token":""}`,
+		`{"event":"auth","token":42}`,
+	} {
+		if _, err := Parse([]byte(msg)); err == nil {
+			t.Fatal("Should return error", msg)
+		}
+	}
+}
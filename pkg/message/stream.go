@@ -0,0 +1,125 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scopes of the streams which are not prefixed
+const (
+	ScopePublic  = "public"
+	ScopePrivate = "private"
+)
+
+// StreamName is a stream of a subscription request.
+//
+// The scope of a stream is either given explicitly, e.g. public:eurusd.trades,
+// private:order or admin:eurusd.ob-inc, or guessed from the number of dots of
+// the name: none for private streams, two for prefixed streams and one for
+// public streams. Only the explicit syntax supports market ids and event types
+// containing dots.
+type StreamName struct {
+	// public, private or the prefix of a prefixed stream
+	Scope string
+
+	// Topic name with its modifiers, without the scope
+	Name string
+}
+
+// ParseStreamName returns the scope and the name of a stream.
+func ParseStreamName(stream string) (StreamName, error) {
+	if stream == "" {
+		return StreamName{}, fmt.Errorf("Could not parse stream: empty name")
+	}
+
+	i := strings.IndexByte(stream, ':')
+	if i < 0 {
+		n := legacyStreamName(stream)
+		return n, n.validate(stream)
+	}
+
+	n := StreamName{
+		Scope: stream[:i],
+		Name:  stream[i+1:],
+	}
+
+	if !validScope(n.Scope) {
+		return n, fmt.Errorf("Could not parse stream %s: invalid scope", stream)
+	}
+	if strings.Contains(n.Name, "*") {
+		return n, fmt.Errorf("Could not parse stream %s: patterns cannot be scoped", stream)
+	}
+
+	return n, n.validate(stream)
+}
+
+// legacyStreamName guesses the scope of a stream without explicit scope.
+func legacyStreamName(stream string) StreamName {
+	switch strings.Count(StreamBase(stream), ".") {
+	case 0:
+		return StreamName{Scope: ScopePrivate, Name: stream}
+	case 2:
+		i := strings.IndexByte(stream, '.')
+		return StreamName{Scope: stream[:i], Name: stream[i+1:]}
+	default:
+		return StreamName{Scope: ScopePublic, Name: stream}
+	}
+}
+
+// String returns the name of the stream in the legacy syntax if its scope
+// can be guessed from it, in the explicit syntax otherwise.
+func (n StreamName) String() string {
+	legacy := n.Name
+	if n.Scope != ScopePublic && n.Scope != ScopePrivate {
+		legacy = n.Scope + "." + n.Name
+	}
+
+	if legacyStreamName(legacy) == n {
+		return legacy
+	}
+	return n.Scope + ":" + n.Name
+}
+
+func (n StreamName) validate(stream string) error {
+	if n.Name == "" {
+		return fmt.Errorf("Could not parse stream %s: missing name", stream)
+	}
+
+	if n.Scope == "" {
+		return fmt.Errorf("Could not parse stream %s: empty segment", stream)
+	}
+
+	if strings.ContainsAny(n.Name, ": \t\r\n,") {
+		return fmt.Errorf("Could not parse stream %s: invalid character", stream)
+	}
+
+	for _, segment := range strings.Split(StreamBase(n.Name), ".") {
+		if segment == "" {
+			return fmt.Errorf("Could not parse stream %s: empty segment", stream)
+		}
+	}
+
+	return nil
+}
+
+// StreamBase returns the name of a stream without its modifiers, e.g.
+// eurusd.ob-inc for eurusd.ob-inc#0.1@20.
+func StreamBase(name string) string {
+	if i := strings.IndexAny(name, "@#"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+func validScope(scope string) bool {
+	if scope == "" {
+		return false
+	}
+
+	for _, c := range scope {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
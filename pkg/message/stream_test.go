@@ -0,0 +1,81 @@
+package message
+
+import (
+	"testing"
+)
+
+func TestParseStreamName(t *testing.T) {
+	for stream, expected := range map[string]StreamName{
+		"order":                    {ScopePrivate, "order"},
+		"eurusd.trades":            {ScopePublic, "eurusd.trades"},
+		"eurusd.ob-inc@20":         {ScopePublic, "eurusd.ob-inc@20"},
+		"eurusd.ob-inc#0.1":        {ScopePublic, "eurusd.ob-inc#0.1"},
+		"admin.eurusd.sys":         {"admin", "eurusd.sys"},
+		"public:eurusd.trades":     {ScopePublic, "eurusd.trades"},
+		"public:eur.usd.trades":    {ScopePublic, "eur.usd.trades"},
+		"public:tickers":           {ScopePublic, "tickers"},
+		"private:order":            {ScopePrivate, "order"},
+		"private:order.v2":         {ScopePrivate, "order.v2"},
+		"admin:eurusd.ob-inc":      {"admin", "eurusd.ob-inc"},
+		"admin:eur.usd.ob-inc#0.1": {"admin", "eur.usd.ob-inc#0.1"},
+	} {
+		n, err := ParseStreamName(stream)
+		if err != nil {
+			t.Fatal("Should not return error", stream, err)
+		}
+		if n != expected {
+			t.Fatalf("Stream %s parsed as %v", stream, n)
+		}
+	}
+
+	for _, stream := range []string{
+		"",
+		":eurusd.trades",
+		"Admin:eurusd.trades",
+		"public:",
+		"public:eurusd..trades",
+		"public:*.trades",
+		"private:order:new",
+		".eurusd.trades",
+		"eurusd.trades ",
+	} {
+		if _, err := ParseStreamName(stream); err == nil {
+			t.Fatal("Should return error", stream)
+		}
+	}
+}
+
+func TestStreamName_String(t *testing.T) {
+	for expected, n := range map[string]StreamName{
+		"order":                 {ScopePrivate, "order"},
+		"eurusd.trades":         {ScopePublic, "eurusd.trades"},
+		"admin.eurusd.sys":      {"admin", "eurusd.sys"},
+		"public:tickers":        {ScopePublic, "tickers"},
+		"public:eur.usd.trades": {ScopePublic, "eur.usd.trades"},
+		"private:order.v2":      {ScopePrivate, "order.v2"},
+		"admin:eur.usd.sys":     {"admin", "eur.usd.sys"},
+	} {
+		if s := n.String(); s != expected {
+			t.Fatalf("Stream %v named %s, expected %s", n, s, expected)
+		}
+
+		parsed, err := ParseStreamName(expected)
+		if err != nil || parsed != n {
+			t.Fatalf("Stream %s parsed as %v: %v", expected, parsed, err)
+		}
+	}
+}
+
+func TestStreamBase(t *testing.T) {
+	for name, expected := range map[string]string{
+		"eurusd.ob-inc":         "eurusd.ob-inc",
+		"eurusd.ob-inc@20":      "eurusd.ob-inc",
+		"eurusd.ob-inc#0.1@20":  "eurusd.ob-inc",
+		"global.tickers@1s":     "global.tickers",
+		"admin.eurusd.ob-inc@1": "admin.eurusd.ob-inc",
+	} {
+		if base := StreamBase(name); base != expected {
+			t.Fatalf("Base of %s is %s, expected %s", name, base, expected)
+		}
+	}
+}
@@ -8,8 +8,15 @@ import (
 var defaultMetrics *Metrics
 
 type Metrics struct {
-	clients prometheus.Gauge
-	subs    *prometheus.GaugeVec
+	clients    prometheus.Gauge
+	subs       *prometheus.GaugeVec
+	gaps       *prometheus.CounterVec
+	duplicates *prometheus.CounterVec
+	outOfOrder *prometheus.CounterVec
+	held       *prometheus.CounterVec
+	snapReqs   *prometheus.CounterVec
+	resumes    *prometheus.CounterVec
+	slow       *prometheus.CounterVec
 }
 
 func Enable() {
@@ -32,6 +39,62 @@ func registerMetrics() {
 		},
 		[]string{"type", "topic"},
 	)
+
+	defaultMetrics.gaps = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_sequence_gaps_total",
+			Help: "Number of gaps detected in the sequence of incremental topics",
+		},
+		[]string{"topic"},
+	)
+
+	defaultMetrics.duplicates = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_sequence_duplicates_total",
+			Help: "Number of duplicate increments ignored",
+		},
+		[]string{"topic"},
+	)
+
+	defaultMetrics.outOfOrder = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_sequence_out_of_order_total",
+			Help: "Number of out of order increments ignored",
+		},
+		[]string{"topic"},
+	)
+
+	defaultMetrics.held = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_held_increments_total",
+			Help: "Number of increments held while waiting for a snapshot",
+		},
+		[]string{"topic"},
+	)
+
+	defaultMetrics.snapReqs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_snapshot_requests_total",
+			Help: "Number of snapshots requested to the upstream",
+		},
+		[]string{"topic"},
+	)
+
+	defaultMetrics.resumes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_session_resumes_total",
+			Help: "Number of sessions resumed or failed to resume",
+		},
+		[]string{"result"},
+	)
+
+	defaultMetrics.slow = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rango_hub_slow_consumer_actions_total",
+			Help: "Number of messages dropped or conflated and connections closed by the slow consumer policy",
+		},
+		[]string{"policy", "action"},
+	)
 }
 
 func RecordHubClientNew() {
@@ -61,3 +124,52 @@ func RecordHubUnsubscription(typ, topic string) {
 	}
 	defaultMetrics.subs.WithLabelValues(typ, topic).Dec()
 }
+
+func RecordSequenceGap(topic string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.gaps.WithLabelValues(topic).Inc()
+}
+
+func RecordSequenceDuplicate(topic string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.duplicates.WithLabelValues(topic).Inc()
+}
+
+func RecordSequenceOutOfOrder(topic string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.outOfOrder.WithLabelValues(topic).Inc()
+}
+
+func RecordHeldIncrement(topic string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.held.WithLabelValues(topic).Inc()
+}
+
+func RecordSnapshotRequest(topic string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.snapReqs.WithLabelValues(topic).Inc()
+}
+
+func RecordSessionResume(result string) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.resumes.WithLabelValues(result).Inc()
+}
+
+func RecordSlowConsumer(policy, action string, count int) {
+	if defaultMetrics == nil {
+		return
+	}
+	defaultMetrics.slow.WithLabelValues(policy, action).Add(float64(count))
+}
@@ -0,0 +1,172 @@
+package orderbook
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Grouping aggregates the price levels of a book in buckets of a tick size.
+// Bids are rounded down and asks are rounded up to the tick, so the buckets
+// never overlap the spread.
+type Grouping struct {
+	tick  *big.Rat
+	scale int
+}
+
+// NewGrouping creates a grouping from a decimal tick size, e.g. "0.1".
+func NewGrouping(tick string) (*Grouping, error) {
+	t, ok := new(big.Rat).SetString(tick)
+	if !ok || t.Sign() <= 0 || strings.ContainsAny(tick, "eE/") {
+		return nil, fmt.Errorf("invalid tick size %q", tick)
+	}
+
+	return &Grouping{
+		tick:  t,
+		scale: decimals(tick),
+	}, nil
+}
+
+// Group returns a new book with the aggregated levels of the book.
+func (g *Grouping) Group(b *Book) *Book {
+	return &Book{
+		Sequence: b.Sequence,
+		Asks:     &Side{desc: false, levels: g.groupLevels(b.Asks.levels, true)},
+		Bids:     &Side{desc: true, levels: g.groupLevels(b.Bids.levels, false)},
+	}
+}
+
+// Regroup updates the grouped book with the buckets of the levels changed by
+// the update, which must have already been applied to the book.
+func (g *Grouping) Regroup(grouped, b *Book, u *Update) {
+	for _, pair := range u.Asks {
+		g.regroupLevel(grouped.Asks, b.Asks, pair[0], true)
+	}
+
+	for _, pair := range u.Bids {
+		g.regroupLevel(grouped.Bids, b.Bids, pair[0], false)
+	}
+
+	grouped.Sequence = b.Sequence
+}
+
+// bucket returns the bucket of the price, asks are rounded up.
+func (g *Grouping) bucket(price string, ceil bool) *big.Rat {
+	p, ok := new(big.Rat).SetString(price)
+	if !ok {
+		return nil
+	}
+
+	q := new(big.Rat).Quo(p, g.tick)
+	n := new(big.Int).Quo(q.Num(), q.Denom())
+	if ceil && !q.IsInt() {
+		n.Add(n, big.NewInt(1))
+	}
+	return new(big.Rat).Mul(new(big.Rat).SetInt(n), g.tick)
+}
+
+// inBucket reports whether the price falls in the bucket, the prices which
+// cannot be bucketed fall in none.
+func (g *Grouping) inBucket(price string, ceil bool, bucket *big.Rat) bool {
+	b := g.bucket(price, ceil)
+	return b != nil && b.Cmp(bucket) == 0
+}
+
+func (g *Grouping) groupLevels(levels []Level, ceil bool) []Level {
+	res := []Level{}
+	var current *big.Rat
+	var amounts []string
+
+	flush := func() {
+		if current != nil {
+			if l, ok := g.level(current, amounts); ok {
+				res = append(res, l)
+			}
+		}
+	}
+
+	for _, l := range levels {
+		b := g.bucket(l.Price, ceil)
+		if b == nil {
+			continue
+		}
+		if current == nil || current.Cmp(b) != 0 {
+			flush()
+			current = b
+			amounts = amounts[:0]
+		}
+		amounts = append(amounts, l.Amount)
+	}
+	flush()
+
+	return res
+}
+
+func (g *Grouping) regroupLevel(grouped, side *Side, price string, ceil bool) {
+	b := g.bucket(price, ceil)
+	if b == nil {
+		return
+	}
+
+	p, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return
+	}
+
+	// Levels of a bucket are contiguous, they are collected around the
+	// position of the changed price.
+	amounts := []string{}
+	i := side.search(p)
+	for j := i - 1; j >= 0 && g.inBucket(side.levels[j].Price, ceil, b); j-- {
+		amounts = append(amounts, side.levels[j].Amount)
+	}
+	for j := i; j < len(side.levels) && g.inBucket(side.levels[j].Price, ceil, b); j++ {
+		amounts = append(amounts, side.levels[j].Amount)
+	}
+
+	l, ok := g.level(b, amounts)
+	if !ok {
+		l = Level{Price: b.FloatString(g.scale), price: ratFloat(b)}
+	}
+	grouped.set(l)
+}
+
+// level returns the bucket level with the sum of the amounts, the amount is
+// formatted with the largest precision of the summed amounts.
+func (g *Grouping) level(bucket *big.Rat, amounts []string) (Level, bool) {
+	sum := new(big.Rat)
+	scale := 0
+	for _, a := range amounts {
+		r, ok := new(big.Rat).SetString(a)
+		if !ok {
+			continue
+		}
+		sum.Add(sum, r)
+		if d := decimals(a); d > scale {
+			scale = d
+		}
+	}
+
+	if sum.Sign() == 0 {
+		return Level{}, false
+	}
+
+	return Level{
+		Price:  bucket.FloatString(g.scale),
+		Amount: sum.FloatString(scale),
+		price:  ratFloat(bucket),
+	}, true
+}
+
+func ratFloat(r *big.Rat) float64 {
+	f, _ := r.Float64()
+	return f
+}
+
+func decimals(s string) int {
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return len(s) - i - 1
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package orderbook
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGrouping(t *testing.T) {
+	for _, tick := range []string{"", "0", "-1", "abc", "1e2", "1/2"} {
+		_, err := NewGrouping(tick)
+		assert.Error(t, err, tick)
+	}
+
+	g, err := NewGrouping("0.10")
+	require.NoError(t, err)
+	assert.Equal(t, 2, g.scale)
+}
+
+func TestGrouping(t *testing.T) {
+	b, err := NewBook(&Update{
+		Asks:     [][]string{{"1.1", "1"}, {"1.15", "0.5"}, {"1.2", "2"}, {"1.21", "0.25"}},
+		Bids:     [][]string{{"1.09", "1"}, {"1.0", "2"}, {"0.95", "0.125"}},
+		Sequence: 5,
+	})
+	require.NoError(t, err)
+
+	g, err := NewGrouping("0.1")
+	require.NoError(t, err)
+
+	grouped := g.Group(b)
+	snap, err := grouped.MarshalSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, `{"asks":[["1.1","1"],["1.2","2.5"],["1.3","0.25"]],"bids":[["1.0","3"],["0.9","0.125"]],"sequence":5}`, string(snap))
+
+	u := &Update{
+		Asks:     [][]string{{"1.15", ""}, {"1.25", "1.5"}},
+		Bids:     [][]string{{"0.95", ""}, {"1.05", "0.5"}},
+		Sequence: 6,
+	}
+	require.NoError(t, b.Apply(u))
+	g.Regroup(grouped, b, u)
+
+	snap, err = grouped.MarshalSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, `{"asks":[["1.1","1"],["1.2","2"],["1.3","1.75"]],"bids":[["1.0","3.5"]],"sequence":6}`, string(snap))
+
+	// Regrouping gives the same result as grouping from scratch
+	regrouped, err := g.Group(b).MarshalSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, string(regrouped), string(snap))
+}
+
+func TestGroupingNonFinite(t *testing.T) {
+	for _, pair := range [][]string{{"Inf", "1"}, {"-Inf", "1"}, {"NaN", "1"}, {"1.1", "Inf"}, {"1.1", "NaN"}} {
+		_, err := NewBook(&Update{Asks: [][]string{pair}})
+		assert.Error(t, err, pair)
+	}
+
+	b, err := NewBook(&Update{Asks: [][]string{{"1.1", "1"}, {"1.15", "0.5"}}})
+	require.NoError(t, err)
+	assert.Error(t, b.Apply(&Update{Asks: [][]string{{"1.12", "1"}, {"Inf", "1"}}}))
+	assert.Len(t, b.Asks.levels, 2)
+
+	g, err := NewGrouping("0.1")
+	require.NoError(t, err)
+	grouped := g.Group(b)
+
+	// Levels which cannot be bucketed end the scan of a bucket
+	b.Asks.levels = append(b.Asks.levels, Level{Price: "Inf", Amount: "1", price: math.Inf(1)})
+	u := &Update{Asks: [][]string{{"1.15", "0.25"}}}
+	require.NoError(t, b.Apply(u))
+	g.Regroup(grouped, b, u)
+
+	snap, err := grouped.MarshalSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, `{"asks":[["1.1","1"],["1.2","0.25"]],"bids":[],"sequence":0}`, string(snap))
+}
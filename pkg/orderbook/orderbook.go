@@ -0,0 +1,287 @@
+package orderbook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Update is the body of an order book snapshot or increment as published by
+// the upstream, price levels are [price, amount] pairs.
+type Update struct {
+	Asks     [][]string `json:"asks,omitempty"`
+	Bids     [][]string `json:"bids,omitempty"`
+	Sequence int64      `json:"sequence,omitempty"`
+}
+
+// Level is a price level of one side of the book.
+type Level struct {
+	Price  string
+	Amount string
+
+	price float64
+}
+
+// Side holds the price levels of one side of the book sorted from the best
+// price to the worst one.
+type Side struct {
+	desc   bool
+	levels []Level
+}
+
+// Book is an order book materialized from a snapshot and the increments
+// applied to it.
+type Book struct {
+	Sequence int64
+	Asks     *Side
+	Bids     *Side
+}
+
+// ParseUpdate decodes an order book snapshot or increment body.
+func ParseUpdate(data []byte) (*Update, error) {
+	u := &Update{}
+	if err := json.Unmarshal(data, u); err != nil {
+		return nil, fmt.Errorf("invalid order book update: %w", err)
+	}
+	return u, nil
+}
+
+// NewBook creates a book from a snapshot.
+func NewBook(snapshot *Update) (*Book, error) {
+	b := &Book{
+		Asks: &Side{desc: false},
+		Bids: &Side{desc: true},
+	}
+
+	if err := b.Apply(snapshot); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Apply updates the book with the levels of an increment, levels with an
+// empty or zero amount are removed. The book is left untouched if the
+// increment contains an invalid level.
+func (b *Book) Apply(u *Update) error {
+	asks, err := parseLevels(u.Asks)
+	if err != nil {
+		return err
+	}
+
+	bids, err := parseLevels(u.Bids)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range asks {
+		b.Asks.set(l)
+	}
+
+	for _, l := range bids {
+		b.Bids.set(l)
+	}
+
+	if u.Sequence != 0 {
+		b.Sequence = u.Sequence
+	}
+	return nil
+}
+
+// Snapshot returns the current state of the book.
+func (b *Book) Snapshot() *Update {
+	return &Update{
+		Asks:     Pairs(b.Asks.levels),
+		Bids:     Pairs(b.Bids.levels),
+		Sequence: b.Sequence,
+	}
+}
+
+// MarshalSnapshot returns the JSON body of the current state of the book.
+func (b *Book) MarshalSnapshot() ([]byte, error) {
+	return b.Snapshot().MarshalSnapshot()
+}
+
+// MarshalSnapshot encodes the update as a snapshot, keeping the empty sides
+// unlike increments.
+func (u *Update) MarshalSnapshot() ([]byte, error) {
+	asks, bids := u.Asks, u.Bids
+	if asks == nil {
+		asks = [][]string{}
+	}
+	if bids == nil {
+		bids = [][]string{}
+	}
+
+	return json.Marshal(struct {
+		Asks     [][]string `json:"asks"`
+		Bids     [][]string `json:"bids"`
+		Sequence int64      `json:"sequence"`
+	}{asks, bids, u.Sequence})
+}
+
+// Merge adds the levels of the next increment to the update, the last amount
+// of a price level wins.
+func (u *Update) Merge(next *Update) {
+	u.Asks = mergePairs(u.Asks, next.Asks)
+	u.Bids = mergePairs(u.Bids, next.Bids)
+	if next.Sequence != 0 {
+		u.Sequence = next.Sequence
+	}
+}
+
+func mergePairs(pairs, next [][]string) [][]string {
+	index := make(map[string]int, len(pairs))
+	for i, pair := range pairs {
+		if len(pair) > 0 {
+			index[pair[0]] = i
+		}
+	}
+
+	for _, pair := range next {
+		if len(pair) == 0 {
+			continue
+		}
+		if i, ok := index[pair[0]]; ok {
+			pairs[i] = pair
+			continue
+		}
+		index[pair[0]] = len(pairs)
+		pairs = append(pairs, pair)
+	}
+
+	return pairs
+}
+
+// Len returns the number of price levels.
+func (s *Side) Len() int {
+	return len(s.levels)
+}
+
+// Levels returns the price levels from the best price to the worst one.
+func (s *Side) Levels() []Level {
+	return s.levels
+}
+
+// Top returns a copy of the n best price levels.
+func (s *Side) Top(n int) []Level {
+	if n > len(s.levels) {
+		n = len(s.levels)
+	}
+	res := make([]Level, n)
+	copy(res, s.levels[:n])
+	return res
+}
+
+// Pairs converts levels to [price, amount] pairs.
+func Pairs(levels []Level) [][]string {
+	res := make([][]string, len(levels))
+	for i, l := range levels {
+		res[i] = []string{l.Price, l.Amount}
+	}
+	return res
+}
+
+// Diff returns the [price, amount] pairs to apply to the old levels to get the
+// new ones, removed levels have an empty amount.
+func Diff(old, new []Level) [][]string {
+	var res [][]string
+	prev := make(map[float64]string, len(old))
+	for _, l := range old {
+		prev[l.price] = l.Amount
+	}
+
+	next := make(map[float64]bool, len(new))
+	for _, l := range new {
+		next[l.price] = true
+		if amount, ok := prev[l.price]; !ok || amount != l.Amount {
+			res = append(res, []string{l.Price, l.Amount})
+		}
+	}
+
+	for _, l := range old {
+		if !next[l.price] {
+			res = append(res, []string{l.Price, ""})
+		}
+	}
+
+	return res
+}
+
+// search returns the index of the price level or the index where it should be
+// inserted.
+func (s *Side) search(price float64) int {
+	return sort.Search(len(s.levels), func(i int) bool {
+		if s.desc {
+			return s.levels[i].price <= price
+		}
+		return s.levels[i].price >= price
+	})
+}
+
+func (s *Side) set(l Level) {
+	i := s.search(l.price)
+	found := i < len(s.levels) && s.levels[i].price == l.price
+
+	switch {
+	case l.Amount == "" && found:
+		s.levels = append(s.levels[:i], s.levels[i+1:]...)
+
+	case l.Amount == "":
+
+	case found:
+		s.levels[i] = l
+
+	default:
+		s.levels = append(s.levels, Level{})
+		copy(s.levels[i+1:], s.levels[i:])
+		s.levels[i] = l
+	}
+}
+
+// parseFinite parses a decimal number, infinities and NaN are rejected since
+// they cannot be grouped nor compared.
+func parseFinite(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, errors.New("not a finite number")
+	}
+	return f, nil
+}
+
+// parseLevels converts [price, amount] pairs to levels, the amount of the
+// levels to remove is set to an empty string.
+func parseLevels(pairs [][]string) ([]Level, error) {
+	levels := make([]Level, len(pairs))
+
+	for i, pair := range pairs {
+		if len(pair) < 2 {
+			return nil, fmt.Errorf("invalid price level %v", pair)
+		}
+
+		price, err := parseFinite(pair[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid price %q: %w", pair[0], err)
+		}
+
+		levels[i] = Level{Price: pair[0], Amount: pair[1], price: price}
+		if pair[1] == "" {
+			continue
+		}
+
+		amount, err := parseFinite(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid amount %q: %w", pair[1], err)
+		}
+		if amount == 0 {
+			levels[i].Amount = ""
+		}
+	}
+
+	return levels, nil
+}
@@ -0,0 +1,117 @@
+package orderbook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUpdate(t *testing.T) {
+	u, err := ParseUpdate([]byte(`{"asks":[["1020.0","0.015"]],"sequence":497773}`))
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"1020.0", "0.015"}}, u.Asks)
+	assert.Nil(t, u.Bids)
+	assert.Equal(t, int64(497773), u.Sequence)
+
+	_, err = ParseUpdate([]byte(`[1588204800,215.3]`))
+	assert.Error(t, err)
+}
+
+func TestBook(t *testing.T) {
+	b, err := NewBook(&Update{
+		Asks:     [][]string{{"1026.0", "0.03"}, {"1020.0", "0.005"}},
+		Bids:     [][]string{{"999.0", "0.005"}, {"1000.0", "0.25"}},
+		Sequence: 10,
+	})
+	require.NoError(t, err)
+
+	snap, err := b.MarshalSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, `{"asks":[["1020.0","0.005"],["1026.0","0.03"]],"bids":[["1000.0","0.25"],["999.0","0.005"]],"sequence":10}`, string(snap))
+
+	t.Run("update, insert and remove levels", func(t *testing.T) {
+		require.NoError(t, b.Apply(&Update{
+			Asks:     [][]string{{"1020.0", "0.015"}, {"1023.0", "1"}, {"1026.0", ""}},
+			Bids:     [][]string{{"1000.0", "0"}, {"1001", "2"}},
+			Sequence: 11,
+		}))
+
+		snap, err := b.MarshalSnapshot()
+		require.NoError(t, err)
+		assert.Equal(t, `{"asks":[["1020.0","0.015"],["1023.0","1"]],"bids":[["1001","2"],["999.0","0.005"]],"sequence":11}`, string(snap))
+	})
+
+	t.Run("removing an unknown level is a no-op", func(t *testing.T) {
+		require.NoError(t, b.Apply(&Update{
+			Bids:     [][]string{{"500", ""}},
+			Sequence: 12,
+		}))
+		assert.Equal(t, 2, b.Bids.Len())
+		assert.Equal(t, int64(12), b.Sequence)
+	})
+
+	t.Run("invalid increments are not applied", func(t *testing.T) {
+		assert.Error(t, b.Apply(&Update{
+			Asks: [][]string{{"1030.0", "1"}},
+			Bids: [][]string{{"abc", "1"}},
+		}))
+		assert.Error(t, b.Apply(&Update{
+			Asks: [][]string{{"1030.0"}},
+		}))
+		assert.Error(t, b.Apply(&Update{
+			Asks: [][]string{{"1030.0", "x"}},
+		}))
+		assert.Equal(t, 2, b.Asks.Len())
+		assert.Equal(t, int64(12), b.Sequence)
+	})
+
+	t.Run("empty book", func(t *testing.T) {
+		b, err := NewBook(&Update{Sequence: 1})
+		require.NoError(t, err)
+
+		snap, err := b.MarshalSnapshot()
+		require.NoError(t, err)
+		assert.Equal(t, `{"asks":[],"bids":[],"sequence":1}`, string(snap))
+	})
+}
+
+func TestTopAndDiff(t *testing.T) {
+	b, err := NewBook(&Update{
+		Asks: [][]string{{"1020.0", "1"}, {"1021.0", "2"}, {"1022.0", "3"}},
+		Bids: [][]string{{"1000.0", "1"}, {"999.0", "2"}},
+	})
+	require.NoError(t, err)
+
+	asks := b.Asks.Top(2)
+	assert.Equal(t, [][]string{{"1020.0", "1"}, {"1021.0", "2"}}, Pairs(asks))
+	assert.Equal(t, 2, len(b.Bids.Top(5)))
+	assert.Nil(t, Diff(asks, b.Asks.Top(2)))
+
+	// The best level is removed, the third one moves into view
+	require.NoError(t, b.Apply(&Update{Asks: [][]string{{"1020.0", ""}, {"1021.0", "2.5"}}}))
+	assert.Equal(t, [][]string{{"1021.0", "2.5"}, {"1022.0", "3"}, {"1020.0", ""}}, Diff(asks, b.Asks.Top(2)))
+
+	// Changes out of the view are ignored
+	asks = b.Asks.Top(2)
+	require.NoError(t, b.Apply(&Update{Asks: [][]string{{"1030.0", "1"}}}))
+	assert.Nil(t, Diff(asks, b.Asks.Top(2)))
+
+	u := &Update{Asks: Pairs(asks), Sequence: 3}
+	snap, err := u.MarshalSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, `{"asks":[["1021.0","2.5"],["1022.0","3"]],"bids":[],"sequence":3}`, string(snap))
+}
+
+func TestMerge(t *testing.T) {
+	u := &Update{}
+	u.Merge(&Update{Asks: [][]string{{"1020.0", "1"}, {"1021.0", "2"}}, Sequence: 11})
+	u.Merge(&Update{Asks: [][]string{{"1020.0", ""}}, Bids: [][]string{{"1000.0", "3"}}, Sequence: 12})
+	u.Merge(&Update{Bids: [][]string{{"1000.0", "4"}}, Sequence: 13})
+
+	assert.Equal(t, &Update{
+		Asks:     [][]string{{"1020.0", ""}, {"1021.0", "2"}},
+		Bids:     [][]string{{"1000.0", "4"}},
+		Sequence: 13,
+	}, u)
+}
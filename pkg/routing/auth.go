@@ -0,0 +1,98 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TokenValidator returns the identity of the user of a JWT, or an error if
+// the token is invalid.
+type TokenValidator func(token string) (Auth, error)
+
+var (
+	errAuthDisabled = errors.New("authentication is disabled")
+	errAuthAnother  = errors.New("already authenticated as another user")
+)
+
+// handleAuth authenticates the connection of an auth request. An anonymous
+// connection is upgraded to an authenticated one, it can subscribe to private
+// streams afterwards.
+func (h *Hub) handleAuth(req *Request) {
+	if h.ValidateToken == nil {
+		req.client.Send(responseMust(errAuthDisabled, nil))
+		return
+	}
+
+	auth, err := h.ValidateToken(req.Token)
+	if err == nil && auth.UID == "" {
+		err = errors.New("missing uid")
+	}
+	if err != nil {
+		log.Info().Msgf("In-band authentication failed: %s", err.Error())
+		req.client.Send(responseMust(fmt.Errorf("authentication failed: %w", err), nil))
+		return
+	}
+
+	current := req.client.GetAuth()
+	if current.UID != "" && current.UID != auth.UID {
+		req.client.Send(responseMust(errAuthAnother, nil))
+		return
+	}
+
+	// A new token of the user may carry another role
+	streams := h.recheckRole(req.client, auth)
+	log.Info().Msgf("Connection authenticated in-band: %s", auth.UID)
+	req.client.Send(responseMust(nil, map[string]interface{}{
+		"message": "authenticated",
+		"uid":     auth.UID,
+	}))
+	if current.UID != "" && current.Role != auth.Role {
+		h.sendRoleChanged(req.client, auth.Role, streams)
+	}
+
+	if current.UID == "" {
+		h.users.add(req.client, auth.UID)
+		h.openSession(req.client, "", "")
+		h.attachSession(req.client)
+	}
+	h.watchExpiry(req.client)
+}
+
+// handleRefresh replaces the token of an authenticated connection by a new
+// one of the same user, postponing its expiry.
+func (h *Hub) handleRefresh(req *Request) {
+	if h.ValidateToken == nil {
+		req.client.Send(responseMust(errAuthDisabled, nil))
+		return
+	}
+
+	current := req.client.GetAuth()
+	if current.UID == "" {
+		req.client.Send(responseMust(errors.New("not authenticated"), nil))
+		return
+	}
+
+	auth, err := h.ValidateToken(req.Token)
+	if err != nil {
+		req.client.Send(responseMust(fmt.Errorf("refresh failed: %w", err), nil))
+		return
+	}
+	if auth.UID != current.UID {
+		req.client.Send(responseMust(errors.New("refresh failed: token of another user"), nil))
+		return
+	}
+
+	streams := h.recheckRole(req.client, auth)
+	h.watchExpiry(req.client)
+
+	res := map[string]interface{}{"message": "refreshed"}
+	if !auth.ExpiresAt.IsZero() {
+		res["expires_at"] = auth.ExpiresAt.Unix()
+	}
+	req.client.Send(responseMust(nil, res))
+	if current.Role != auth.Role {
+		h.sendRoleChanged(req.client, auth.Role, streams)
+	}
+}
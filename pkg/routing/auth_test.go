@@ -0,0 +1,97 @@
+package routing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testValidator(token string) (Auth, error) {
+	if token == "invalid" {
+		return Auth{}, errors.New("signature is invalid")
+	}
+	return Auth{UID: token, Role: "member"}, nil
+}
+
+func authRequest(c IClient, token string) *Request {
+	return &Request{client: c, Request: message.Request{Method: "auth", Token: token}}
+}
+
+func TestHandleAuth(t *testing.T) {
+	h := NewHub(nil)
+	c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+
+	h.handleRequest(authRequest(c, "UID123"))
+	assert.Equal(t, []string{`{"error":"authentication is disabled"}`}, queuedTexts(c.send))
+
+	h.ValidateToken = testValidator
+	h.handleRequest(authRequest(c, "invalid"))
+	assert.Equal(t, []string{`{"error":"authentication failed: signature is invalid"}`}, queuedTexts(c.send))
+	assert.Equal(t, Auth{}, c.GetAuth())
+
+	h.handleRequest(authRequest(c, "UID123"))
+	assert.Equal(t, []string{`{"success":{"message":"authenticated","uid":"UID123"}}`}, queuedTexts(c.send))
+	assert.Equal(t, Auth{UID: "UID123", Role: "member"}, c.GetAuth())
+
+	// Private streams can be subscribed once authenticated
+	h.handleRequest(&Request{client: c, Request: message.Request{Method: "subscribe", Streams: []string{"order"}}})
+	assert.Equal(t, []string{`{"success":{"message":"subscribed","streams":["order"]}}`}, queuedTexts(c.send))
+	h.routeMessage(orderEvent(1))
+	assert.Equal(t, []string{`{"order":{"id":1}}`}, queuedTexts(c.send))
+
+	h.handleRequest(authRequest(c, "UID456"))
+	assert.Equal(t, []string{`{"error":"already authenticated as another user"}`}, queuedTexts(c.send))
+	assert.Equal(t, "UID123", c.GetAuth().UID)
+}
+
+func TestHandleAuthSession(t *testing.T) {
+	h := NewHub(nil)
+	h.ValidateToken = testValidator
+	h.Sessions = NewSessions(time.Minute, 10)
+	c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil), session: true}
+
+	h.handleRequest(authRequest(c, "UID123"))
+	texts := queuedTexts(c.send)
+	require.Len(t, texts, 2)
+	assert.Equal(t, `{"success":{"message":"authenticated","uid":"UID123"}}`, texts[0])
+	assert.Contains(t, texts[1], `"message":"session created"`)
+
+	// Sessions are opt-in
+	c = &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+	h.handleRequest(authRequest(c, "UID123"))
+	assert.Equal(t, []string{`{"success":{"message":"authenticated","uid":"UID123"}}`}, queuedTexts(c.send))
+}
+
+func TestHandleAuthRoleChange(t *testing.T) {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+	h.ValidateToken = func(token string) (Auth, error) {
+		return Auth{UID: "UID123", Role: token}, nil
+	}
+	c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+
+	h.handleRequest(authRequest(c, "admin"))
+	h.handleRequest(&Request{client: c, Request: message.Request{Method: "subscribe", Streams: []string{"eurusd.trades", "admin.eurusd.sys"}}})
+	queuedTexts(c.send)
+
+	// The prefixed streams the new role is not allowed to are unsubscribed
+	h.handleRequest(authRequest(c, "member"))
+	assert.Equal(t, []string{
+		`{"success":{"message":"authenticated","uid":"UID123"}}`,
+		`{"role_changed":{"role":"member","streams":["admin.eurusd.sys"]}}`,
+	}, queuedTexts(c.send))
+	assert.Equal(t, []string{"eurusd.trades"}, c.GetSubscriptions())
+
+	h.routeMessage(&Event{Scope: "admin", Stream: "eurusd", Type: "sys", Topic: "eurusd.sys", Body: 1})
+	assert.Empty(t, queuedTexts(c.send))
+
+	h.handleRequest(&Request{client: c, Request: message.Request{Method: "refresh", Token: "admin"}})
+	assert.Equal(t, []string{
+		`{"success":{"message":"refreshed"}}`,
+		`{"role_changed":{"role":"admin","streams":[]}}`,
+	}, queuedTexts(c.send))
+	assert.Equal(t, "admin", c.GetAuth().Role)
+}
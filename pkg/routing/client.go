@@ -2,10 +2,15 @@ package routing
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -34,16 +39,27 @@ var (
 )
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     checkSameOrigin(os.Getenv("API_CORS_ORIGINS")),
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	CheckOrigin:       checkSameOrigin(os.Getenv("API_CORS_ORIGINS")),
+	EnableCompression: os.Getenv("RANGO_WEBSOCKET_COMPRESSION") == "true",
 }
 
 var maxBufferedMessages = 256
 
+// Formats of the frames batching the messages of the connections asking for
+// it with the batch query parameter
+const (
+	batchArray  = "array"
+	batchNDJSON = "ndjson"
+)
+
 type Auth struct {
 	UID  string
 	Role string
+
+	// Expiry of the token, zero if it does not expire
+	ExpiresAt time.Time
 }
 
 // FIXME: IClient looks very wrong.
@@ -51,6 +67,7 @@ type IClient interface {
 	Send(string)
 	Close()
 	GetAuth() Auth
+	SetAuth(Auth)
 	GetSubscriptions() []string
 	SubscribePublic(string)
 	SubscribePrivate(string)
@@ -58,6 +75,64 @@ type IClient interface {
 	UnsubscribePrivate(string)
 }
 
+// eventSender is implemented by the clients writing to a websocket. The
+// events are queued with their topic for the slow consumer policy, and the
+// messages sent to many clients are framed once for all of them.
+type eventSender interface {
+	sendEvent(outbound)
+}
+
+// disconnecter is implemented by the clients which can be closed with a
+// close code, without writing their queued messages but an optional notice.
+type disconnecter interface {
+	disconnect(code int, reason, notice string)
+}
+
+// sessionRequester is implemented by the clients which can ask for a
+// resumable session.
+type sessionRequester interface {
+	sessionRequested() bool
+}
+
+// preparedMessage is a message sent to several connections. Its websocket
+// frames are built by the first connection writing it, once per compression
+// mode, and reused by the others.
+type preparedMessage struct {
+	text string
+	once sync.Once
+	pm   *websocket.PreparedMessage
+	err  error
+}
+
+// outbound is a message waiting to be written to the websocket, written
+// from its prepared frames when it is sent to several connections.
+type outbound struct {
+	text     string
+	prepared *preparedMessage
+
+	// Topic of the events, empty for the responses and the replays which
+	// are never dropped
+	topic string
+
+	// Lane of the message, the private one for the responses
+	lane int
+
+	// Written in its own frame even if the messages are batched, set for
+	// the pong responses which are not JSON
+	unbatched bool
+}
+
+func newPreparedMessage(text string) *preparedMessage {
+	return &preparedMessage{text: text}
+}
+
+func (m *preparedMessage) prepare() (*websocket.PreparedMessage, error) {
+	m.once.Do(func() {
+		m.pm, m.err = websocket.NewPreparedMessage(websocket.TextMessage, []byte(m.text))
+	})
+	return m.pm, m.err
+}
+
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	hub *Hub
@@ -68,11 +143,24 @@ type Client struct {
 	pubSub  []string
 	privSub []string
 
+	// Guards the subscriptions, read by the hub when a session is resumed
+	// from another connection, and the authentication
+	mutex sync.Mutex
+
+	// Set when the connection asked for a resumable session
+	session bool
+
 	// The websocket connection.
 	conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+	// Queue of outbound messages.
+	send *sendQueue
+
+	// Format and maximum size of the frames batching the queued messages,
+	// the messages are written one per frame if the format is empty
+	batch     string
+	batchSize int
+	batchBuf  []byte
 }
 
 func checkSameOrigin(origins string) func(r *http.Request) bool {
@@ -134,10 +222,11 @@ func NewClient(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	client := &Client{
 		hub:  hub,
 		conn: conn,
-		send: make(chan []byte, maxBufferedMessages),
+		send: newSendQueue(maxBufferedMessages, hub.SlowConsumerPolicy),
 		Auth: Auth{
-			UID:  r.Header.Get("JwtUID"),
-			Role: r.Header.Get("JwtRole"),
+			UID:       r.Header.Get("JwtUID"),
+			Role:      r.Header.Get("JwtRole"),
+			ExpiresAt: parseExpiry(r.Header.Get("JwtExpiresAt")),
 		},
 		pubSub:  []string{},
 		privSub: []string{},
@@ -149,12 +238,20 @@ func NewClient(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		log.Info().Msgf("New authenticated connection: %s", client.Auth.UID)
 	}
 
+	query := r.URL.Query()
+	client.negotiateBatch(query.Get("batch"))
+	client.session = query.Get("session") == "1"
+	restored := hub.openSession(client, query.Get("resume"), query.Get("last_seq"))
+
 	hub.handleSubscribe(&Request{
 		client: client,
 		Request: msg.Request{
-			Streams: parseStreamsFromURI(r.RequestURI),
+			Streams: append(restored, parseStreamsFromURI(r.RequestURI)...),
 		},
 	})
+	hub.attachSession(client)
+	hub.watchExpiry(client)
+	hub.users.add(client, client.Auth.UID)
 
 	metrics.RecordHubClientNew()
 
@@ -164,40 +261,85 @@ func NewClient(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	go client.read()
 }
 
-func (c *Client) Send(s string) {
-	if len(c.send) == maxBufferedMessages {
-		log.Warn().Msg("Closing slow websocket connection")
-		c.conn.Close()
-	} else {
-		c.send <- []byte(s)
+func (c *Client) sessionRequested() bool {
+	return c.session
+}
+
+// negotiateBatch enables the batching of the messages in the format asked by
+// the client, if supported.
+func (c *Client) negotiateBatch(format string) {
+	switch {
+	case format == "":
+		return
+	case format != batchArray && format != batchNDJSON:
+		c.Send(responseMust(fmt.Errorf("unsupported batch format: %s", format), nil))
+	case c.hub.MaxBatchSize <= 0:
+		c.Send(responseMust(errors.New("batching is disabled"), nil))
+	default:
+		c.batch = format
+		c.batchSize = c.hub.MaxBatchSize
 	}
 }
 
+func (c *Client) Send(s string) {
+	c.send.push(outbound{text: s})
+}
+
+func (c *Client) sendEvent(m outbound) {
+	c.send.push(m)
+}
+
+func (c *Client) disconnect(code int, reason, notice string) {
+	c.send.disconnect(code, reason, notice)
+}
+
 func (c *Client) Close() {
-	close(c.send)
+	c.send.close()
 }
 
 func (c *Client) GetAuth() Auth {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	return c.Auth
 }
 
+func (c *Client) SetAuth(auth Auth) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Auth = auth
+}
+
 func (c *Client) GetSubscriptions() []string {
-	return append(c.pubSub, c.privSub...)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append(append([]string{}, c.pubSub...), c.privSub...)
 }
 
 func (c *Client) SubscribePublic(s string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if !contains(c.pubSub, s) {
 		c.pubSub = append(c.pubSub, s)
 	}
 }
 
 func (c *Client) SubscribePrivate(s string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if !contains(c.privSub, s) {
 		c.privSub = append(c.privSub, s)
 	}
 }
 
 func (c *Client) UnsubscribePublic(s string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	l := make([]string, len(c.pubSub)-1)
 	i := 0
 	for _, el := range c.pubSub {
@@ -210,6 +352,9 @@ func (c *Client) UnsubscribePublic(s string) {
 }
 
 func (c *Client) UnsubscribePrivate(s string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	l := make([]string, len(c.privSub)-1)
 	i := 0
 	for _, el := range c.privSub {
@@ -221,6 +366,15 @@ func (c *Client) UnsubscribePrivate(s string) {
 	c.privSub = l
 }
 
+// parseExpiry returns the time of a unix timestamp, zero if empty or invalid.
+func parseExpiry(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
 func parseStreamsFromURI(uri string) []string {
 	streams := make([]string, 0)
 	path := strings.Split(uri, "?")
@@ -276,17 +430,17 @@ func (c *Client) read() {
 
 		// handle ping
 		if string(message) == "ping" {
-			c.send <- []byte("pong")
+			c.send.push(outbound{text: "pong", unbatched: true})
 			continue
 		}
 
 		req, err := msg.ParseRequest(message)
 		if err != nil {
-			c.send <- []byte(responseMust(err, nil))
+			c.Send(responseMust(err, nil))
 			continue
 		}
 
-		c.hub.Requests <- Request{c, req}
+		c.hub.Requests <- Request{client: c, Request: req}
 	}
 }
 
@@ -305,20 +459,34 @@ func (c *Client) write() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.send.ready:
+			// The queue is popped message by message so that a private
+			// message queued meanwhile is written before the public ones
+			for {
+				message, ok := c.send.pop()
+				if !ok {
+					break
+				}
+
+				var err error
+				if c.batch != "" && !message.unbatched {
+					err = c.writeBatch(message)
+				} else {
+					err = c.writeMessage(message)
+				}
+				if err != nil {
+					return
+				}
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-			if err := w.Close(); err != nil {
+			if closed, code, reason := c.send.done(); closed {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if code == 0 {
+					// The hub closed the queue.
+					c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				} else {
+					c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+				}
 				return
 			}
 		case <-ticker.C:
@@ -329,3 +497,56 @@ func (c *Client) write() {
 		}
 	}
 }
+
+func (c *Client) writeMessage(message outbound) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	if message.prepared != nil {
+		// The frame matching the compression negotiated by the connection is
+		// built once and shared by the connections
+		pm, err := message.prepared.prepare()
+		if err != nil {
+			log.Error().Msgf("Failed to prepare message: %s", err.Error())
+			return nil
+		}
+		return c.conn.WritePreparedMessage(pm)
+	}
+
+	w, err := c.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, message.text)
+	return w.Close()
+}
+
+// writeBatch writes the message in a single frame with the next queued
+// messages fitting in the batch size, as a JSON array or separated by
+// newlines.
+func (c *Client) writeBatch(first outbound) error {
+	b := c.batchBuf[:0]
+	sep := byte('\n')
+	if c.batch == batchArray {
+		b = append(b, '[')
+		sep = ','
+	}
+	b = append(b, first.text...)
+
+	for {
+		// Room left for the separator and the closing bracket
+		m, ok := c.send.popBatched(c.batchSize - len(b) - 2)
+		if !ok {
+			break
+		}
+		b = append(b, sep)
+		b = append(b, m.text...)
+	}
+
+	if c.batch == batchArray {
+		b = append(b, ']')
+	}
+	c.batchBuf = b
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.TextMessage, b)
+}
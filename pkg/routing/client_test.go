@@ -1,17 +1,23 @@
 package routing
 
 import (
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestClient(t *testing.T) {
 	hub := NewHub(nil)
 	client := &Client{
 		hub:     hub,
-		send:    make(chan []byte, 256),
+		send:    newSendQueue(256, nil),
 		Auth:    Auth{UID: "UIDABC001", Role: "admin"},
 		pubSub:  []string{},
 		privSub: []string{},
@@ -137,3 +143,120 @@ func TestCheckSameOriginBadConfiguration(t *testing.T) {
 	assert.Panics(t, func() { checkSameOrigin("https://ex ample.org") })
 	assert.Panics(t, func() { checkSameOrigin("https://ex:ample.org") })
 }
+
+func TestPreparedBroadcast(t *testing.T) {
+	defer func(enabled bool) { upgrader.EnableCompression = enabled }(upgrader.EnableCompression)
+	upgrader.EnableCompression = true
+
+	h := NewHub(nil)
+	go h.ListenWebsocketEvents()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewClient(h, w, r)
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?stream=eurusd.trades"
+	conns := make([]*websocket.Conn, 0, 2)
+	for _, compression := range []bool{true, false} {
+		dialer := websocket.Dialer{EnableCompression: compression}
+		conn, res, err := dialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		negotiated := strings.Contains(res.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+		assert.Equal(t, compression, negotiated)
+
+		_, confirmation, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, `{"success":{"message":"subscribed","streams":["eurusd.trades"]}}`, string(confirmation))
+		conns = append(conns, conn)
+	}
+
+	for i := 1; i <= 2; i++ {
+		h.routeMessage(tradeEvent("public", i))
+	}
+
+	for _, conn := range conns {
+		for i := 1; i <= 2; i++ {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			typ, message, err := conn.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, websocket.TextMessage, typ)
+			assert.Equal(t, fmt.Sprintf(`{"eurusd.trades":{"tid":%d}}`, i), string(message))
+		}
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	trade := func(i int) string {
+		return fmt.Sprintf(`{"eurusd.trades":{"tid":%d}}`, i)
+	}
+
+	for _, tc := range []struct {
+		format string
+		size   int
+		frames []string
+	}{
+		{batchArray, 1024, []string{"pong", "[" + trade(1) + "," + trade(2) + "," + trade(3) + "]"}},
+		{batchArray, 2*len(trade(1)) + 3, []string{"pong", "[" + trade(1) + "," + trade(2) + "]", "[" + trade(3) + "]"}},
+		{batchNDJSON, 1024, []string{"pong", trade(1) + "\n" + trade(2) + "\n" + trade(3)}},
+		{"", 1024, []string{"pong", trade(1), trade(2), trade(3)}},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			require.NoError(t, err)
+
+			c := &Client{conn: conn, send: newSendQueue(maxBufferedMessages, nil), batch: tc.format, batchSize: tc.size}
+			for i := 1; i <= 3; i++ {
+				c.sendEvent(outbound{text: trade(i), topic: "eurusd.trades", lane: lanePublic})
+			}
+			c.send.push(outbound{text: "pong", unbatched: true})
+			c.Close()
+			c.write()
+		}))
+
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		require.NoError(t, err)
+
+		for _, frame := range tc.frames {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, message, err := conn.ReadMessage()
+			require.NoError(t, err, tc.format)
+			assert.Equal(t, frame, string(message), tc.format)
+		}
+		_, _, err = conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseNoStatusReceived), err)
+
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestNegotiateBatch(t *testing.T) {
+	h := NewHub(nil)
+	h.MaxBatchSize = 1024
+
+	for format, expected := range map[string]string{
+		"":       "",
+		"array":  batchArray,
+		"ndjson": batchNDJSON,
+		"xml":    "",
+	} {
+		c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+		c.negotiateBatch(format)
+		assert.Equal(t, expected, c.batch, format)
+	}
+
+	c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+	c.negotiateBatch("xml")
+	m, _ := c.send.pop()
+	assert.Equal(t, `{"error":"unsupported batch format: xml"}`, m.text)
+
+	h.MaxBatchSize = 0
+	c = &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+	c.negotiateBatch("array")
+	assert.Equal(t, "", c.batch)
+	m, _ = c.send.pop()
+	assert.Equal(t, `{"error":"batching is disabled"}`, m.text)
+}
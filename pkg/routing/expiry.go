@@ -0,0 +1,159 @@
+package routing
+
+import (
+	"sync"
+	"time"
+
+	msg "github.com/openware/rango/pkg/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Close code of the connections whose token expired
+const closeTokenExpired = 4001
+
+// Number of expired clients buffered before the expiry timers block, they
+// are handled by the hub goroutine between the requests of the clients.
+var expiredBuffer = 256
+
+// TokenExpiry enforces the expiry of the tokens of the authenticated
+// connections. The clients are warned before their token expires and can
+// refresh it with a new one of the same user.
+type TokenExpiry struct {
+	// Time before the expiry at which the client is warned, no warning is
+	// sent when zero
+	Warning time.Duration
+
+	// Close the connection on expiry, the private and prefixed streams are
+	// unsubscribed and the connection becomes anonymous otherwise
+	Close bool
+
+	mutex  sync.Mutex
+	timers map[IClient]*expiryTimers
+}
+
+type expiryTimers struct {
+	warning *time.Timer
+	expiry  *time.Timer
+}
+
+func NewTokenExpiry(warning time.Duration, close bool) *TokenExpiry {
+	return &TokenExpiry{
+		Warning: warning,
+		Close:   close,
+		timers:  make(map[IClient]*expiryTimers),
+	}
+}
+
+// watchExpiry schedules the warning and the expiry of the token of a client,
+// replacing the ones of its previous token.
+func (h *Hub) watchExpiry(c IClient) {
+	e := h.TokenExpiry
+	if e == nil {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.stop(c)
+
+	auth := c.GetAuth()
+	if auth.UID == "" || auth.ExpiresAt.IsZero() {
+		return
+	}
+
+	expiresAt := auth.ExpiresAt
+	t := &expiryTimers{}
+	if e.Warning > 0 {
+		d := time.Until(expiresAt) - e.Warning
+		if d < 0 {
+			d = 0
+		}
+		t.warning = time.AfterFunc(d, func() {
+			if c.GetAuth().ExpiresAt.Equal(expiresAt) {
+				c.Send(string(eventMust("token_expiring", map[string]interface{}{
+					"expires_at": expiresAt.Unix(),
+				})))
+			}
+		})
+	}
+	t.expiry = time.AfterFunc(time.Until(expiresAt), func() {
+		h.expired <- c
+	})
+	e.timers[c] = t
+}
+
+// stopExpiry cancels the timers of a client leaving.
+func (h *Hub) stopExpiry(c IClient) {
+	e := h.TokenExpiry
+	if e == nil {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.stop(c)
+}
+
+func (e *TokenExpiry) stop(c IClient) {
+	t, ok := e.timers[c]
+	if !ok {
+		return
+	}
+
+	if t.warning != nil {
+		t.warning.Stop()
+	}
+	t.expiry.Stop()
+	delete(e.timers, c)
+}
+
+// expireToken handles a client whose token expired, unless it was refreshed
+// meanwhile.
+func (h *Hub) expireToken(c IClient) {
+	auth := c.GetAuth()
+	if auth.UID == "" || auth.ExpiresAt.IsZero() || time.Now().Before(auth.ExpiresAt) {
+		return
+	}
+
+	h.stopExpiry(c)
+	log.Info().Msgf("Token of %s expired", auth.UID)
+
+	if h.TokenExpiry.Close {
+		if d, ok := c.(disconnecter); ok {
+			d.disconnect(closeTokenExpired, "token expired", "")
+		} else {
+			c.Close()
+		}
+		return
+	}
+
+	// The session keeps the private messages, it can be resumed by a new
+	// connection with a fresh token
+	if h.Sessions != nil {
+		sh := h.shardFor(auth.UID)
+		sh.mutex.Lock()
+		h.Sessions.detach(c)
+		sh.mutex.Unlock()
+	}
+
+	// The private and prefixed streams are unsubscribed while the client is
+	// still authenticated, its private topics are found by its UID
+	req := &Request{client: c}
+	streams := []string{}
+	for _, t := range c.GetSubscriptions() {
+		n, err := msg.ParseStreamName(t)
+		if err != nil || n.Scope == msg.ScopePublic {
+			continue
+		}
+		h.unsubscribeStream(t, n, req)
+		streams = append(streams, t)
+	}
+
+	h.users.remove(c, auth.UID)
+	c.SetAuth(Auth{})
+	c.Send(string(eventMust("token_expired", map[string]interface{}{
+		"streams": streams,
+	})))
+}
@@ -0,0 +1,161 @@
+package routing
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expiringValidator accepts the tokens "<uid>:<expiry in ms>".
+func expiringValidator(token string) (Auth, error) {
+	for i := range token {
+		if token[i] == ':' {
+			ms, err := strconv.Atoi(token[i+1:])
+			if err != nil {
+				return Auth{}, err
+			}
+			return Auth{
+				UID:       token[:i],
+				Role:      "member",
+				ExpiresAt: time.Now().Add(time.Duration(ms) * time.Millisecond),
+			}, nil
+		}
+	}
+	return Auth{}, errors.New("token is malformed")
+}
+
+func refreshRequest(c IClient, token string) *Request {
+	return &Request{client: c, Request: message.Request{Method: "refresh", Token: token}}
+}
+
+func TestTokenExpiryWarning(t *testing.T) {
+	h := NewHub(nil)
+	h.TokenExpiry = NewTokenExpiry(time.Minute, false)
+	h.ValidateToken = expiringValidator
+	go h.ListenWebsocketEvents()
+
+	c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+	h.handleRequest(authRequest(c, "UID123:200"))
+	expiresAt := c.GetAuth().ExpiresAt.Unix()
+
+	// The warning is sent right away as the token expires within a minute
+	var texts []string
+	require.Eventually(t, func() bool {
+		texts = append(texts, queuedTexts(c.send)...)
+		return len(texts) >= 3
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, []string{
+		`{"success":{"message":"authenticated","uid":"UID123"}}`,
+		`{"token_expiring":{"expires_at":` + strconv.FormatInt(expiresAt, 10) + `}}`,
+		`{"token_expired":{"streams":[]}}`,
+	}, texts)
+	assert.Equal(t, Auth{}, c.GetAuth())
+}
+
+func TestTokenExpiryUnsubscribe(t *testing.T) {
+	h := NewHub(nil)
+	h.TokenExpiry = NewTokenExpiry(0, false)
+	c := &Client{
+		hub:  h,
+		send: newSendQueue(maxBufferedMessages, nil),
+		Auth: Auth{UID: "UID123", ExpiresAt: time.Now().Add(-time.Second)},
+	}
+
+	h.handleRequest(&Request{client: c, Request: message.Request{Method: "subscribe", Streams: []string{"eurusd.trades", "order"}}})
+	queuedTexts(c.send)
+
+	h.expireToken(c)
+	assert.Equal(t, []string{`{"token_expired":{"streams":["order"]}}`}, queuedTexts(c.send))
+	assert.Equal(t, []string{"eurusd.trades"}, c.GetSubscriptions())
+	assert.Equal(t, Auth{}, c.GetAuth())
+
+	// The public streams are still delivered, the private ones are not
+	h.routeMessage(orderEvent(1))
+	h.routeMessage(tradeEvent("public", 1))
+	assert.Equal(t, []string{`{"eurusd.trades":{"tid":1}}`}, queuedTexts(c.send))
+}
+
+func TestTokenExpiryBuffered(t *testing.T) {
+	h := NewHub(nil)
+	h.TokenExpiry = NewTokenExpiry(0, true)
+	c := &Client{
+		hub:  h,
+		send: newSendQueue(maxBufferedMessages, nil),
+		Auth: Auth{UID: "UID123", ExpiresAt: time.Now().Add(time.Millisecond)},
+	}
+
+	// The timer does not wait for the hub to handle the expiry
+	h.watchExpiry(c)
+	require.Eventually(t, func() bool {
+		return len(h.expired) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestTokenExpiryClose(t *testing.T) {
+	h := NewHub(nil)
+	h.TokenExpiry = NewTokenExpiry(0, true)
+	c := &Client{
+		hub:  h,
+		send: newSendQueue(maxBufferedMessages, nil),
+		Auth: Auth{UID: "UID123", ExpiresAt: time.Now().Add(time.Minute)},
+	}
+
+	// The token is not expired yet
+	h.expireToken(c)
+	closed, _, _ := c.send.done()
+	assert.False(t, closed)
+
+	c.SetAuth(Auth{UID: "UID123", ExpiresAt: time.Now().Add(-time.Second)})
+	c.Send("queued")
+	h.expireToken(c)
+	closed, code, reason := c.send.done()
+	assert.True(t, closed)
+	assert.Equal(t, closeTokenExpired, code)
+	assert.Equal(t, "token expired", reason)
+}
+
+func TestHandleRefresh(t *testing.T) {
+	h := NewHub(nil)
+	h.TokenExpiry = NewTokenExpiry(0, true)
+	c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+
+	h.handleRequest(refreshRequest(c, "UID123:60000"))
+	assert.Equal(t, []string{`{"error":"authentication is disabled"}`}, queuedTexts(c.send))
+
+	h.ValidateToken = expiringValidator
+	h.handleRequest(refreshRequest(c, "UID123:60000"))
+	assert.Equal(t, []string{`{"error":"not authenticated"}`}, queuedTexts(c.send))
+
+	h.handleRequest(authRequest(c, "UID123:60000"))
+	queuedTexts(c.send)
+	expiresAt := c.GetAuth().ExpiresAt
+
+	h.handleRequest(refreshRequest(c, "UID456:120000"))
+	assert.Equal(t, []string{`{"error":"refresh failed: token of another user"}`}, queuedTexts(c.send))
+	h.handleRequest(refreshRequest(c, "invalid"))
+	assert.Equal(t, []string{`{"error":"refresh failed: token is malformed"}`}, queuedTexts(c.send))
+	assert.Equal(t, expiresAt, c.GetAuth().ExpiresAt)
+
+	h.handleRequest(refreshRequest(c, "UID123:120000"))
+	refreshed := c.GetAuth().ExpiresAt
+	assert.True(t, refreshed.After(expiresAt))
+	assert.Equal(t, []string{
+		`{"success":{"expires_at":` + strconv.FormatInt(refreshed.Unix(), 10) + `,"message":"refreshed"}}`,
+	}, queuedTexts(c.send))
+
+	// The timers of the previous token are replaced
+	h.TokenExpiry.mutex.Lock()
+	assert.Len(t, h.TokenExpiry.timers, 1)
+	h.TokenExpiry.mutex.Unlock()
+
+	h.stopExpiry(c)
+	h.TokenExpiry.mutex.Lock()
+	assert.Empty(t, h.TokenExpiry.timers)
+	h.TokenExpiry.mutex.Unlock()
+}
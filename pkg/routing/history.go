@@ -0,0 +1,164 @@
+package routing
+
+import (
+	"path"
+)
+
+// History keeps the last messages of the public and prefixed topics of the
+// configured event types. Clients subscribing with a history parameter
+// receive them before any live message.
+type History struct {
+	// map[event type -> number of messages kept], shell patterns such as
+	// kline-* are supported
+	sizes map[string]int
+}
+
+// historyBuffer is a ring buffer of the last message bodies of a topic.
+type historyBuffer struct {
+	bodies []interface{}
+	next   int
+	full   bool
+}
+
+// pendingHistory is the history of a topic to send to a new subscriber once
+// the subscription is confirmed.
+type pendingHistory struct {
+	shard  *shard
+	topic  *Topic
+	scope  string
+	key    string
+	stream string
+	count  int
+}
+
+func NewHistory(sizes map[string]int) *History {
+	return &History{
+		sizes: sizes,
+	}
+}
+
+// size returns the number of messages kept for the event type, the largest
+// one if several patterns match.
+func (h *History) size(typ string) int {
+	if size, ok := h.sizes[typ]; ok {
+		return size
+	}
+
+	size := 0
+	for pattern, s := range h.sizes {
+		if ok, _ := path.Match(pattern, typ); ok && s > size {
+			size = s
+		}
+	}
+	return size
+}
+
+func (b *historyBuffer) push(body interface{}) {
+	b.bodies[b.next] = body
+	b.next = (b.next + 1) % len(b.bodies)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+func (b *historyBuffer) len() int {
+	if b.full {
+		return len(b.bodies)
+	}
+	return b.next
+}
+
+// last returns the n last bodies from the oldest to the newest.
+func (b *historyBuffer) last(n int) []interface{} {
+	count := b.len()
+	if n > count {
+		n = count
+	}
+
+	res := make([]interface{}, 0, n)
+	for i := n; i > 0; i-- {
+		res = append(res, b.bodies[(b.next-i+len(b.bodies))%len(b.bodies)])
+	}
+	return res
+}
+
+// storeHistory adds the message to the history of the topic, key is the
+// topic name prefixed by its scope for prefixed topics.
+func (s *shard) storeHistory(h *History, key string, msg *Event) {
+	if h == nil {
+		return
+	}
+
+	b, ok := s.history[key]
+	if !ok {
+		size := h.size(msg.Type)
+		if size <= 0 {
+			return
+		}
+		b = &historyBuffer{bodies: make([]interface{}, size)}
+		s.history[key] = b
+	}
+	b.push(msg.Body)
+}
+
+// queueHistory schedules the last messages of the topic for a new
+// subscriber of the stream and reports whether any will be sent. The client
+// joins the topic once they are sent after the subscription confirmation, so
+// that no live message is sent before the history.
+//
+// The messages replayed for a request are capped to the size of a lane, so
+// that the history alone cannot overflow the queue of the client.
+func (s *shard) queueHistory(scope, key, stream string, topic *Topic, req *Request) bool {
+	n := req.History
+	if room := maxBufferedMessages - req.replayed; n > room {
+		n = room
+	}
+	if n <= 0 {
+		return false
+	}
+
+	b, ok := s.history[key]
+	if !ok || b.len() == 0 {
+		return false
+	}
+	if l := b.len(); n > l {
+		n = l
+	}
+
+	req.replayed += n
+	req.history = append(req.history, pendingHistory{
+		shard:  s,
+		topic:  topic,
+		scope:  scope,
+		key:    key,
+		stream: stream,
+		count:  n,
+	})
+	return true
+}
+
+// historyQueued reports whether the client joins the topic once its history
+// is sent.
+func (req *Request) historyQueued(topic *Topic) bool {
+	for _, p := range req.history {
+		if p.topic == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// sendHistory sends the history queued during the subscription and adds the
+// client to the topics. The messages received meanwhile are part of the
+// history, the client gets each message once and in order.
+func (h *Hub) sendHistory(req *Request) {
+	for _, p := range req.history {
+		p.shard.mutex.Lock()
+		for _, body := range p.shard.history[p.key].last(p.count) {
+			sendTopic(req.client, p.scope, p.stream, string(eventMust(p.stream, body)))
+		}
+		p.topic.subscribe(req.client)
+		p.shard.mutex.Unlock()
+	}
+	req.history = nil
+}
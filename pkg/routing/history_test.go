@@ -0,0 +1,144 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func tradeEvent(scope string, id int) *Event {
+	return &Event{
+		Scope:  scope,
+		Stream: "eurusd",
+		Type:   "trades",
+		Topic:  "eurusd.trades",
+		Body:   map[string]interface{}{"tid": id},
+	}
+}
+
+func TestHistoryBuffer(t *testing.T) {
+	b := &historyBuffer{bodies: make([]interface{}, 3)}
+	assert.Empty(t, b.last(2))
+
+	b.push(1)
+	b.push(2)
+	assert.Equal(t, []interface{}{1, 2}, b.last(5))
+
+	for i := 3; i <= 5; i++ {
+		b.push(i)
+	}
+	assert.Equal(t, []interface{}{4, 5}, b.last(2))
+	assert.Equal(t, []interface{}{3, 4, 5}, b.last(10))
+
+	h := NewHistory(map[string]int{"trades": 100, "kline-*": 50, "kline-1m": 200})
+	assert.Equal(t, 100, h.size("trades"))
+	assert.Equal(t, 50, h.size("kline-12h"))
+	assert.Equal(t, 200, h.size("kline-1m"))
+	assert.Equal(t, 0, h.size("tickers"))
+}
+
+func TestHistoryOnSubscribe(t *testing.T) {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+	h.History = NewHistory(map[string]int{"trades": 3})
+	h.LastValues = NewLastValueCache([]string{"trades"}, time.Minute)
+
+	for i := 1; i <= 4; i++ {
+		h.routeMessage(tradeEvent("public", i))
+	}
+	h.routeMessage(tradeEvent("admin", 10))
+
+	c := &MockedClient{}
+	c.On("GetAuth").Return(Auth{Role: "admin"})
+	c.On("GetSubscriptions").Return([]string{"eurusd.trades", "admin.eurusd.trades"})
+	c.On("SubscribePublic", mock.Anything).Return()
+	c.On("Send", mock.Anything).Return()
+
+	h.handleSubscribe(&Request{
+		client: c,
+		Request: message.Request{
+			Streams: []string{"eurusd.trades", "admin.eurusd.trades"},
+			History: 2,
+		},
+	})
+	h.routeMessage(tradeEvent("public", 5))
+
+	// The history replaces the last value, it comes after the confirmation
+	// and before live messages
+	assert.Equal(t, []string{
+		`{"success":{"message":"subscribed","streams":["eurusd.trades","admin.eurusd.trades"]}}`,
+		`{"eurusd.trades":{"tid":3}}`,
+		`{"eurusd.trades":{"tid":4}}`,
+		`{"eurusd.trades":{"tid":10}}`,
+		`{"eurusd.trades":{"tid":5}}`,
+	}, sentMessages(c))
+
+	t.Run("messages received before the confirmation are part of the history", func(t *testing.T) {
+		c := &MockedClient{}
+		c.On("SubscribePublic", "eurusd.trades").Return()
+		c.On("Send", mock.Anything).Return()
+
+		req := &Request{client: c, Request: message.Request{History: 2}}
+		h.subscribePublic("eurusd.trades", req)
+		h.subscribePublic("eurusd.trades", req)
+		h.routeMessage(tradeEvent("public", 6))
+		assert.Empty(t, sentMessages(c))
+
+		h.sendHistory(req)
+		h.routeMessage(tradeEvent("public", 7))
+		assert.Equal(t, []string{
+			`{"eurusd.trades":{"tid":5}}`,
+			`{"eurusd.trades":{"tid":6}}`,
+			`{"eurusd.trades":{"tid":7}}`,
+		}, sentMessages(c))
+		c.AssertNumberOfCalls(t, "SubscribePublic", 1)
+	})
+
+	t.Run("no history without the parameter", func(t *testing.T) {
+		c := &MockedClient{}
+		c.On("SubscribePublic", "eurusd.trades").Return()
+		c.On("Send", mock.Anything).Return()
+
+		req := &Request{client: c}
+		h.subscribePublic("eurusd.trades", req)
+		assert.Empty(t, sentMessages(c))
+		assert.Equal(t, 1, len(req.lastValues))
+	})
+}
+
+func TestHistoryLimit(t *testing.T) {
+	defer func(n int) { maxBufferedMessages = n }(maxBufferedMessages)
+	maxBufferedMessages = 5
+
+	h := NewHub(nil)
+	h.History = NewHistory(map[string]int{"trades": 10, "kline-*": 10})
+	for i := 1; i <= 4; i++ {
+		h.routeMessage(tradeEvent("public", i))
+		h.routeMessage(&Event{Scope: "public", Stream: "eurusd", Type: "kline-1m", Topic: "eurusd.kline-1m", Body: i})
+	}
+
+	// The history replayed for a request fits in a lane of the queue, it
+	// is dropped by the slow consumer policy like live messages
+	c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, dropOldestPolicy{})}
+	h.handleSubscribe(&Request{
+		client: c,
+		Request: message.Request{
+			Streams: []string{"eurusd.trades", "eurusd.kline-1m"},
+			History: 100,
+		},
+	})
+	h.routeMessage(tradeEvent("public", 5))
+
+	closed, _, _ := c.send.done()
+	assert.False(t, closed)
+	assert.Equal(t, []string{
+		`{"success":{"message":"subscribed","streams":["eurusd.trades","eurusd.kline-1m"]}}`,
+		`{"eurusd.trades":{"tid":2}}`,
+		`{"eurusd.trades":{"tid":3}}`,
+		`{"eurusd.trades":{"tid":4}}`,
+		`{"eurusd.kline-1m":4}`,
+		`{"eurusd.trades":{"tid":5}}`,
+	}, queuedTexts(c.send))
+}
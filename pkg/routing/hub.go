@@ -1,14 +1,15 @@
 package routing
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
-	"sync"
 
 	msg "github.com/openware/rango/pkg/message"
 	"github.com/openware/rango/pkg/metrics"
+	"github.com/openware/rango/pkg/orderbook"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/streadway/amqp"
@@ -17,6 +18,14 @@ import (
 type Request struct {
 	client IClient
 	msg.Request
+
+	// Cached messages to send once the subscription is confirmed
+	lastValues []pendingValue
+
+	// Histories to send once the subscription is confirmed, and the number
+	// of messages they replay
+	history  []pendingHistory
+	replayed int
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the
@@ -28,22 +37,61 @@ type Hub struct {
 	// Unregister requests from clients.
 	Unregister chan IClient
 
-	// List of clients registered to public topics
-	PublicTopics map[string]*Topic
+	// map[prefix -> allowed roles]
+	RBAC map[string][]string
+
+	// Requests fresh snapshots to the upstream when an incremental topic
+	// lacks one, disabled when nil
+	SnapshotRequester *SnapshotRequester
 
-	// List of clients registered to private topics
-	PrivateTopics map[string]map[string]*Topic
+	// Last messages of the public and prefixed topics sent to new
+	// subscribers, disabled when nil
+	LastValues *LastValueCache
 
-	// map[prefix -> map[topic -> *Topic]]
-	PrefixedTopics map[string]map[string]*Topic
+	// Buffers of the last messages of the public and prefixed topics
+	// replayed to the subscribers asking for them, disabled when nil
+	History *History
 
-	// Storage for incremental objects
-	IncrementalObjects map[string]*IncrementalObject
+	// Private messages retained for resumable connections, disabled when
+	// nil
+	Sessions *Sessions
 
-	// map[prefix -> allowed roles]
-	RBAC map[string][]string
+	// Rules mapping the AMQP routing keys to events, only the
+	// scope.stream.type and scope.type keys are accepted when nil
+	RoutingRules *RoutingRules
+
+	// Applied to the connections whose queue of outbound messages is full,
+	// they are disconnected when nil
+	SlowConsumerPolicy SlowConsumerPolicy
 
-	mutex sync.Mutex
+	// Validates the tokens of the in-band auth requests, which are rejected
+	// when nil
+	ValidateToken TokenValidator
+
+	// Warns and unsubscribes or disconnects the clients whose token
+	// expired, the expiry is not enforced when nil
+	TokenExpiry *TokenExpiry
+
+	// Routing keys of the control messages revoking the sessions of a user
+	// and changing its role, they are not consumed when empty
+	RevokeRoutingKey string
+	RoleRoutingKey   string
+
+	// Maximum size of the frames batching the messages of the connections
+	// asking for it, batching is disabled when zero
+	MaxBatchSize int
+
+	// Topic registries partitioned by topic name (or UID for private topics)
+	shards []*shard
+
+	// Clients whose token expired
+	expired chan IClient
+
+	// Control messages received from the upstream
+	controls chan *control
+
+	// Authenticated connections by UID
+	users *connections
 }
 
 type Event struct {
@@ -52,23 +100,60 @@ type Event struct {
 	Type   string      // event type
 	Topic  string      // topic routing key (stream.type)
 	Body   interface{} // event json body
+
+	// Order book update of the body, decoded once by orderBookUpdate
+	update    *orderbook.Update
+	updateErr error
+}
+
+// orderBookUpdate returns the order book update of the body, decoded the
+// first time it is needed and shared by the sequence check, the book and its
+// views.
+func (msg *Event) orderBookUpdate() (*orderbook.Update, error) {
+	if msg.update == nil && msg.updateErr == nil {
+		msg.update, msg.updateErr = parseOrderBookUpdate(msg.Body)
+	}
+	return msg.update, msg.updateErr
 }
 
 type IncrementalObject struct {
 	Snapshot   string
 	Increments []string
+
+	// Order book materialized from the snapshot and increments, set
+	// instead of Snapshot and Increments for order book topics
+	Book *orderbook.Book
+
+	// Topic of the snapshot messages (stream.type-snap)
+	SnapshotTopic string
+
+	// Sequence of the last snapshot or increment applied
+	Sequence int64
+
+	// Stale is set when an increment was lost, until the next snapshot
+	Stale bool
+
+	// Increments received while the object is stale
+	held []*Event
 }
 
 func NewHub(rbac map[string][]string) *Hub {
-	return &Hub{
-		Requests:           make(chan Request),
-		Unregister:         make(chan IClient),
-		PublicTopics:       make(map[string]*Topic, 100),
-		PrivateTopics:      make(map[string]map[string]*Topic, 1000),
-		PrefixedTopics:     make(map[string]map[string]*Topic, 100),
-		IncrementalObjects: make(map[string]*IncrementalObject, 5),
-		RBAC:               rbac,
+	h := &Hub{
+		Requests:   make(chan Request),
+		Unregister: make(chan IClient),
+		RBAC:       rbac,
+		expired:    make(chan IClient, expiredBuffer),
+		controls:   make(chan *control, controlsBuffer),
+		users:      newConnections(),
+		shards:     make([]*shard, shardsCount),
 	}
+
+	for i := range h.shards {
+		h.shards[i] = newShard()
+		go h.routeShardEvents(h.shards[i])
+	}
+
+	return h
 }
 
 func isIncrementObject(s string) bool {
@@ -79,6 +164,10 @@ func isSnapshotObject(s string) bool {
 	return strings.HasSuffix(s, "-snap")
 }
 
+func isOrderBookObject(s string) bool {
+	return s == "ob-inc" || s == "ob-snap"
+}
+
 func isDebug() bool {
 	return log.Logger.GetLevel() <= zerolog.DebugLevel
 }
@@ -105,8 +194,16 @@ func (h *Hub) ListenWebsocketEvents() {
 
 		case client := <-h.Unregister:
 			log.Info().Msgf("Unregistering client (%s)", client.GetAuth().UID)
+			h.stopExpiry(client)
+			h.users.remove(client, client.GetAuth().UID)
 			h.unsubscribeAll(client)
 			client.Close()
+
+		case client := <-h.expired:
+			h.expireToken(client)
+
+		case ctl := <-h.controls:
+			h.handleControl(ctl)
 		}
 	}
 }
@@ -116,42 +213,50 @@ func (h *Hub) ReceiveMsg(delivery amqp.Delivery) {
 	if isTrace() {
 		log.Trace().Msgf("AMQP msg received: %s -> %s", delivery.RoutingKey, delivery.Body)
 	}
-	s := strings.Split(delivery.RoutingKey, ".")
 
-	var o interface{}
-	err := json.Unmarshal(delivery.Body, &o)
+	ctl, err := h.parseControl(delivery)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		return
+	}
+	if ctl != nil {
+		h.controls <- ctl
+		return
+	}
 
+	msg, err := h.newEvent(delivery)
 	if err != nil {
-		log.Error().Msgf("JSON parse error: %s, msg: %s", err.Error(), delivery.Body)
+		log.Error().Msg(err.Error())
 		return
 	}
 
-	switch len(s) {
-	case 2:
-		msg := Event{
-			Scope:  s[0],
-			Stream: "",
-			Type:   s[1],
-			Topic:  getTopic(s[0], s[0], s[1]),
-			Body:   o,
-		}
+	h.dispatch(msg)
+}
 
-		h.routeMessage(&msg)
+// newEvent returns the event of an AMQP message. The body is validated but
+// not decoded, it is sent as is to the subscribers.
+func (h *Hub) newEvent(delivery amqp.Delivery) (*Event, error) {
+	var o bytes.Buffer
+	o.Grow(len(delivery.Body))
+	err := json.Compact(&o, delivery.Body)
 
-	case 3:
-		msg := Event{
-			Scope:  s[0],
-			Stream: s[1],
-			Type:   s[2],
-			Topic:  getTopic(s[0], s[1], s[2]),
-			Body:   o,
-		}
+	if err != nil {
+		return nil, fmt.Errorf("JSON parse error: %s, msg: %s", err.Error(), delivery.Body)
+	}
 
-		h.routeMessage(&msg)
+	var msg *Event
+	if h.RoutingRules != nil {
+		msg, err = h.RoutingRules.Map(delivery.RoutingKey)
+	} else {
+		msg, err = parseRoutingKey(delivery.RoutingKey)
+	}
 
-	default:
-		log.Error().Msgf("Bad routing key: %s", delivery.RoutingKey)
+	if err != nil {
+		return nil, err
 	}
+
+	msg.Body = json.RawMessage(o.Bytes())
+	return msg, nil
 }
 
 func (h *Hub) SkipPrivateMsg(delivery amqp.Delivery) {
@@ -162,68 +267,292 @@ func (h *Hub) SkipPrivateMsg(delivery amqp.Delivery) {
 	h.ReceiveMsg(delivery)
 }
 
-func (h *Hub) handleSnapshot(msg *Event) (string, error) {
-	topic := msg.Stream + "." + msg.Type
-	body, err := json.Marshal(map[string]interface{}{
-		topic: msg.Body,
-	})
+// incrementalObjects holds the state of incremental topics by topic name
+type incrementalObjects map[string]*IncrementalObject
 
+func (objects incrementalObjects) handleSnapshot(msg *Event) (string, error) {
+	topic := strings.TrimSuffix(msg.Topic, "-inc") + "-snap"
+	o, ok := objects[msg.Topic]
+	if !ok {
+		o = &IncrementalObject{}
+		objects[msg.Topic] = o
+	}
+	o.SnapshotTopic = topic
+	o.Sequence, _ = msg.sequence()
+	o.Stale = false
+	held := o.held
+	o.held = nil
+
+	// Increments held while the object was stale are applied on top of the
+	// new snapshot, the older ones are discarded by the sequence check.
+	defer func() {
+		for _, inc := range held {
+			if _, err := objects.handleIncrement(inc); err != nil && isDebug() {
+				log.Debug().Msgf("Held increment discarded: %s", err.Error())
+			}
+		}
+	}()
+
+	if isOrderBookObject(msg.Type) {
+		u, err := msg.orderBookUpdate()
+		var book *orderbook.Book
+		if err == nil {
+			book, err = orderbook.NewBook(u)
+		}
+		if err == nil {
+			o.Book = book
+			o.Snapshot = ""
+			o.Increments = nil
+			return "", nil
+		}
+		log.Warn().Msgf("Failed to load order book %s, falling back to replay: %s", msg.Topic, err.Error())
+	}
+
+	body, err := packEvent(topic, msg.Body)
 	if err != nil {
 		return "", err
 	}
 
-	o, ok := h.IncrementalObjects[msg.Topic]
-	if !ok {
-		o = &IncrementalObject{}
-		h.IncrementalObjects[msg.Topic] = o
-	}
+	o.Book = nil
 	o.Snapshot = string(body)
 	o.Increments = []string{}
 
 	return string(body), nil
 }
 
-func (h *Hub) handleIncrement(msg *Event) (string, error) {
-	body, err := json.Marshal(map[string]interface{}{
-		msg.Topic: msg.Body,
-	})
+func (objects incrementalObjects) handleIncrement(msg *Event) (string, error) {
+	o, ok := objects[msg.Topic]
+	if !ok {
+		return "", fmt.Errorf("%w for topic %s, ignoring", errNoSnapshot, msg.Topic)
+	}
+
+	if err := o.checkSequence(msg); err != nil {
+		return "", err
+	}
 
+	body, err := packEvent(msg.Topic, msg.Body)
 	if err != nil {
 		return "", err
 	}
 
-	o, ok := h.IncrementalObjects[msg.Topic]
-	if !ok {
-		return "", fmt.Errorf("No snapshot received before the increment for topic %s, ignoring", msg.Topic)
+	if o.Book != nil {
+		u, err := msg.orderBookUpdate()
+		if err == nil {
+			err = o.Book.Apply(u)
+		}
+		if err != nil {
+			o.fallBackToReplay()
+			o.Increments = append(o.Increments, string(body))
+			return string(body), fmt.Errorf("%w of %s, replaying it until the next snapshot: %s", errBookFailed, msg.Topic, err.Error())
+		}
+		return string(body), nil
 	}
+
 	o.Increments = append(o.Increments, string(body))
 	return string(body), nil
 
 }
 
-func (h *Hub) handleMessage(topic *Topic, ok bool, msg *Event) {
-	switch {
-	case isIncrementObject(msg.Type):
-		rm, err := h.handleIncrement(msg)
+// fallBackToReplay stops materializing the order book of the object, the
+// last state of the book becomes the snapshot replayed with the increments
+// received until the next snapshot.
+func (o *IncrementalObject) fallBackToReplay() {
+	body, err := o.Book.MarshalSnapshot()
+	o.Book = nil
+	o.Snapshot = ""
+	o.Increments = []string{}
+	if err != nil {
+		log.Error().Msgf("Failed to marshal order book %s: %s", o.SnapshotTopic, err.Error())
+		return
+	}
+	o.Snapshot = string(eventMust(o.SnapshotTopic, json.RawMessage(body)))
+}
+
+func parseOrderBookUpdate(body interface{}) (*orderbook.Update, error) {
+	data, err := rawBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return orderbook.ParseUpdate(data)
+}
+
+// rawBody returns the JSON of an event body, as received for the AMQP
+// messages.
+func rawBody(body interface{}) (json.RawMessage, error) {
+	if raw, ok := body.(json.RawMessage); ok {
+		return raw, nil
+	}
+	return json.Marshal(body)
+}
+
+// replay sends the current state of the object to a new subscriber, in the
+// lane of the scope of the topic. A stale object is not replayed, the
+// subscriber is asked to resync until the next snapshot.
+func (o *IncrementalObject) replay(c IClient, scope string) {
+	incTopic := strings.TrimSuffix(o.SnapshotTopic, "-snap") + "-inc"
+	if o.Stale {
+		sendTopic(c, scope, "", resyncMessage(o, incTopic))
+		return
+	}
+
+	if o.Book != nil {
+		body, err := o.Book.MarshalSnapshot()
 		if err != nil {
-			log.Error().Msgf("handleIncrement failed: %s", err.Error())
+			log.Error().Msgf("Failed to marshal order book %s: %s", o.SnapshotTopic, err.Error())
 			return
 		}
-		if ok {
-			topic.broadcastRaw(rm)
+		sendTopic(c, scope, o.SnapshotTopic, string(eventMust(o.SnapshotTopic, json.RawMessage(body))))
+		return
+	}
+
+	if o.Snapshot != "" {
+		sendTopic(c, scope, o.SnapshotTopic, o.Snapshot)
+		for _, inc := range o.Increments {
+			sendTopic(c, scope, incTopic, inc)
 		}
+	}
+}
 
-	case isSnapshotObject(msg.Type):
-		_, err := h.handleSnapshot(msg)
+func (h *Hub) requestSnapshot(msg *Event) {
+	if h.SnapshotRequester != nil {
+		h.SnapshotRequester.Request(msg)
+	}
+}
+
+// incrementFailed handles an increment which could not be applied: a new
+// snapshot is requested to the upstream when the object lacks one or is
+// stale, and the subscribers are asked to resync after a gap.
+func (h *Hub) incrementFailed(objects incrementalObjects, sub subscribers, msg *Event, err error) {
+	switch {
+	case errors.Is(err, errSequenceGap):
+		log.Warn().Msgf("handleIncrement failed, waiting for a new snapshot: %s", err.Error())
+		h.requestSnapshot(msg)
+		sub.broadcastRaw("", resyncMessage(objects[msg.Topic], msg.Topic))
+
+	case errors.Is(err, errBookFailed):
+		log.Warn().Msgf("handleIncrement failed, waiting for a new snapshot: %s", err.Error())
+		h.requestSnapshot(msg)
+
+	case errors.Is(err, errNoSnapshot):
+		log.Error().Msgf("handleIncrement failed: %s", err.Error())
+		h.requestSnapshot(msg)
+
+	case errors.Is(err, errTopicStale):
+		h.requestSnapshot(msg)
+		if isDebug() {
+			log.Debug().Msgf("Increment held on %s: %s", msg.Topic, err.Error())
+		}
+
+	case errors.Is(err, errSequenceDuplicate), errors.Is(err, errSequenceOutOfOrder):
+		if isDebug() {
+			log.Debug().Msgf("Increment ignored on %s: %s", msg.Topic, err.Error())
+		}
+
+	default:
+		log.Error().Msgf("handleIncrement failed: %s", err.Error())
+	}
+}
+
+// snapshotReceived stores a snapshot and sends the new state to the
+// subscribers of the topic if it was stale, they were asked to resync.
+func (h *Hub) snapshotReceived(objects incrementalObjects, sub subscribers, msg *Event) error {
+	o, stale := objects[msg.Topic]
+	stale = stale && o.Stale
+
+	if _, err := objects.handleSnapshot(msg); err != nil {
+		return err
+	}
+
+	o, found := objects[msg.Topic]
+	if !stale || !found {
+		return nil
+	}
+	if o.Stale {
+		sub.broadcastRaw("", resyncMessage(o, msg.Topic))
+		return nil
+	}
+	sub.each(func(c IClient) {
+		o.replay(c, sub.scope)
+	})
+	return nil
+}
+
+func (h *Hub) handleMessage(s *shard, sub subscribers, msg *Event) {
+	switch {
+	case isIncrementObject(msg.Type):
+		rm, err := s.incrementalObjects.handleIncrement(msg)
 		if err != nil {
+			h.incrementFailed(s.incrementalObjects, sub, msg, err)
+			if errors.Is(err, errSequenceGap) || errors.Is(err, errBookFailed) {
+				s.resyncViews(msg.Topic)
+			}
+			// The increments are still forwarded when the book fails
+			if !errors.Is(err, errBookFailed) {
+				return
+			}
+		}
+		sub.broadcastRaw(msg.Topic, rm)
+		s.updateViews(msg)
+
+	case isSnapshotObject(msg.Type):
+		_, existed := s.incrementalObjects[msg.Topic]
+		if err := h.snapshotReceived(s.incrementalObjects, sub, msg); err != nil {
 			log.Error().Msgf("handleSnapshot failed: %s", err.Error())
 			return
 		}
+		if !existed {
+			replayToPatterns(s.incrementalObjects, sub, msg.Topic)
+		}
+		s.updateViews(msg)
 
 	default:
-		if ok {
-			topic.broadcast(msg)
+		s.storeLastValue(h.LastValues, msg.Topic, msg)
+		s.storeHistory(h.History, msg.Topic, msg)
+		sub.broadcast(msg)
+		s.updateDerived(msg)
+	}
+}
+
+// handlePrivateMessage handles the messages of the private topics of a user,
+// the incremental objects are stored per user.
+func (h *Hub) handlePrivateMessage(s *shard, uid string, topic *Topic, msg *Event) {
+	sub := subscribers{topic: topic, scope: "private"}
+
+	switch {
+	case isIncrementObject(msg.Type):
+		objects := s.userObjects(uid)
+		if _, err := objects.handleIncrement(msg); err != nil {
+			h.incrementFailed(objects, sub, msg, err)
+			if !errors.Is(err, errBookFailed) {
+				return
+			}
+		}
+		h.broadcastPrivate(uid, topic, msg)
+
+	case isSnapshotObject(msg.Type):
+		if err := h.snapshotReceived(s.userObjects(uid), sub, msg); err != nil {
+			log.Error().Msgf("handleSnapshot failed: %s", err.Error())
 		}
+
+	default:
+		h.broadcastPrivate(uid, topic, msg)
+	}
+}
+
+func (h *Hub) broadcastPrivate(uid string, topic *Topic, msg *Event) {
+	if h.Sessions != nil {
+		h.Sessions.broadcast(uid, topic, msg)
+		return
+	}
+
+	if topic != nil {
+		topic.broadcast(msg)
+		return
+	}
+
+	if isTrace() {
+		log.Trace().Msgf("No private registration to %s", msg.Topic)
 	}
 }
 
@@ -231,85 +560,123 @@ func (h *Hub) routeMessage(msg *Event) {
 	if isTrace() {
 		log.Trace().Msgf("Routing message %v", msg)
 	}
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	s := h.shardFor(eventShardKey(msg))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
 	switch msg.Scope {
 	case "public", "global":
-		topic, ok := h.PublicTopics[msg.Topic]
-		h.handleMessage(topic, ok, msg)
+		sub := s.subscribersOf("", s.publicTopics[msg.Topic], msg.Topic)
+		h.handleMessage(s, sub, msg)
 
-		if !ok {
+		if sub.empty() {
 			if isTrace() {
 				log.Trace().Msgf("No public registration to %s", msg.Topic)
-				log.Trace().Msgf("Public topics: %v", h.PublicTopics)
+				log.Trace().Msgf("Public topics: %v", s.publicTopics)
 			}
 		}
 
 	case "private":
 		uid := msg.Stream
-		uTopic, ok := h.PrivateTopics[uid]
-		if ok {
-			topic, ok := uTopic[msg.Topic]
-			if ok {
-				topic.broadcast(msg)
-				break
-			}
-		}
-		if isTrace() {
-			log.Trace().Msgf("No private registration to %s", msg.Topic)
-			log.Trace().Msgf("Private topics: %v", h.PrivateTopics)
-		}
+		h.handlePrivateMessage(s, uid, s.privateTopics[uid][msg.Topic], msg)
 
 	default:
-		scope, ok := h.PrefixedTopics[msg.Scope]
-		if !ok {
-			return
+		sub := s.subscribersOf(msg.Scope, s.prefixedTopics[msg.Scope][msg.Topic], msg.Topic)
+		h.handlePrefixedMessage(s, sub, msg)
+	}
+
+}
+
+// handlePrefixedMessage handles the messages of a prefixed scope, the
+// incremental objects and cached messages of each scope are stored apart
+// from the public ones.
+func (h *Hub) handlePrefixedMessage(s *shard, sub subscribers, msg *Event) {
+	key := msg.Scope + "." + msg.Topic
+
+	switch {
+	case isIncrementObject(msg.Type):
+		objects := s.scopeObjects(msg.Scope)
+		rm, err := objects.handleIncrement(msg)
+		if err != nil {
+			h.incrementFailed(objects, sub, msg, err)
+			if !errors.Is(err, errBookFailed) {
+				return
+			}
 		}
+		sub.broadcastRaw(msg.Topic, rm)
 
-		topic, ok := scope[msg.Topic]
-		if !ok {
+	case isSnapshotObject(msg.Type):
+		objects := s.scopeObjects(msg.Scope)
+		_, existed := objects[msg.Topic]
+		if err := h.snapshotReceived(objects, sub, msg); err != nil {
+			log.Error().Msgf("handleSnapshot failed: %s", err.Error())
 			return
 		}
+		if !existed {
+			replayToPatterns(objects, sub, msg.Topic)
+		}
 
-		topic.broadcast(msg)
-
+	default:
+		s.storeLastValue(h.LastValues, key, msg)
+		s.storeHistory(h.History, key, msg)
+		sub.broadcast(msg)
 		log.Trace().Msgf("Broadcasted message scope %s", msg.Scope)
 	}
-
 }
 
 func (h *Hub) unsubscribeAll(client IClient) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
-	for t, topic := range h.PublicTopics {
-		if topic.unsubscribe(client) {
-			metrics.RecordHubUnsubscription("public", t)
-		}
-		if topic.len() == 0 {
-			delete(h.PublicTopics, t)
+	// Patterns are registered on every shard
+	patterns := make(map[string]struct{})
+	for _, s := range h.shards {
+		s.mutex.Lock()
+		for t, topic := range s.publicTopics {
+			if topic.unsubscribe(client) {
+				metrics.RecordHubUnsubscription("public", t)
+			}
+			if topic.len() == 0 {
+				s.deletePublicTopic(t, topic)
+			}
 		}
-	}
 
-	for k, scope := range h.PrefixedTopics {
-		for t, topic := range scope {
-			if topic.unsubscribe(client) {
-				metrics.RecordHubUnsubscription("prefixed", t)
+		for k, scope := range s.prefixedTopics {
+			for t, topic := range scope {
+				if topic.unsubscribe(client) {
+					metrics.RecordHubUnsubscription("prefixed", k+"."+t)
+				}
+
+				if topic.len() == 0 {
+					delete(scope, t)
+				}
 			}
 
-			if topic.len() == 0 {
-				delete(scope, t)
+			if len(scope) == 0 {
+				delete(s.prefixedTopics, k)
 			}
 		}
 
-		if len(scope) == 0 {
-			delete(h.PrefixedTopics, k)
+		for p := range s.patterns {
+			if s.deletePatternClient(p, client) {
+				patterns[p] = struct{}{}
+			}
 		}
+		s.mutex.Unlock()
+	}
+
+	for p := range patterns {
+		metrics.RecordHubUnsubscription("pattern", p)
 	}
 
 	uid := client.GetAuth().UID
-	topics, ok := h.PrivateTopics[uid]
+	s := h.shardFor(uid)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The session keeps the messages of its private topics from now on
+	if h.Sessions != nil {
+		h.Sessions.detach(client)
+	}
+
+	topics, ok := s.privateTopics[uid]
 	if !ok {
 		return
 	}
@@ -324,7 +691,7 @@ func (h *Hub) unsubscribeAll(client IClient) {
 	}
 
 	if len(topics) == 0 {
-		delete(h.PrivateTopics, uid)
+		delete(s.privateTopics, uid)
 	}
 
 }
@@ -339,11 +706,10 @@ func responseMust(e error, r interface{}) string {
 	return string(res)
 }
 
-func isPrivateStream(s string) bool {
-	return strings.Count(s, ".") == 0
-}
-func isPrefixedStream(s string) bool {
-	return strings.Count(s, ".") == 2
+// streamName returns the name of a topic subscription as listed to the
+// client, in the explicit syntax if the legacy one would be ambiguous.
+func streamName(scope, t string) string {
+	return msg.StreamName{Scope: scope, Name: t}.String()
 }
 
 func (h *Hub) handleRequest(req *Request) {
@@ -352,6 +718,10 @@ func (h *Hub) handleRequest(req *Request) {
 		h.handleSubscribe(req)
 	case "unsubscribe":
 		h.handleUnsubscribe(req)
+	case "auth":
+		h.handleAuth(req)
+	case "refresh":
+		h.handleRefresh(req)
 	default:
 		req.client.Send(responseMust(errors.New("unsupported method"), nil))
 	}
@@ -364,47 +734,101 @@ func (h *Hub) subscribePrivate(t string, req *Request) {
 		return
 	}
 
-	uTopics, ok := h.PrivateTopics[uid]
+	s := h.shardFor(uid)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	uTopics, ok := s.privateTopics[uid]
 	if !ok {
 		uTopics = make(map[string]*Topic, 3)
-		h.PrivateTopics[uid] = uTopics
+		s.privateTopics[uid] = uTopics
 	}
 
 	topic, ok := uTopics[t]
 	if !ok {
 		topic = NewTopic(h)
+		topic.scope = msg.ScopePrivate
 		uTopics[t] = topic
 	}
 
 	if topic.subscribe(req.client) {
 		metrics.RecordHubSubscription("private", t)
-		req.client.SubscribePrivate(t)
+		req.client.SubscribePrivate(streamName(msg.ScopePrivate, t))
+	}
+
+	if isIncrementObject(t) {
+		if p, ok := s.privateObjects[uid]; ok {
+			if o, ok := p.objects[t]; ok {
+				o.replay(req.client, msg.ScopePrivate)
+			}
+		}
 	}
 }
 
 func (h *Hub) subscribePublic(t string, req *Request) {
-	topic, ok := h.PublicTopics[t]
+	s := h.shardFor(msg.StreamBase(t))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topic, ok := s.publicTopics[t]
 	if !ok {
-		topic = NewTopic(h)
-		h.PublicTopics[t] = topic
+		derived, err := s.newDerivedTopic(h, t)
+		if err != nil {
+			req.client.Send(responseMust(err, nil))
+			return
+		}
+
+		topic = derived
+		if topic != nil {
+			s.addDerived(topic)
+		} else {
+			topic = NewTopic(h)
+		}
+		s.publicTopics[t] = topic
 	}
 
-	if topic.subscribe(req.client) {
+	if !topic.has(req.client) && !req.historyQueued(topic) {
 		metrics.RecordHubSubscription("public", t)
-		req.client.SubscribePublic(t)
+		req.client.SubscribePublic(streamName(msg.ScopePublic, t))
+
+		// Throttled streams send one message per interval, without history
+		if topic.base != "" || !s.queueHistory(msg.ScopePublic, msg.StreamBase(t), t, topic, req) {
+			topic.subscribe(req.client)
+			if topic.view == nil {
+				s.queueLastValue(h.LastValues, msg.ScopePublic, msg.StreamBase(t), t, topic, req)
+			}
+		}
+	}
+
+	if topic.view != nil {
+		if topic.conflater != nil {
+			topic.conflater.replay(req.client, func() bool {
+				return topic.view.replay(s.incrementalObjects[topic.view.base], req.client)
+			})
+			return
+		}
+		topic.view.replay(s.incrementalObjects[topic.view.base], req.client)
+		return
 	}
 
 	if isIncrementObject(t) {
-		o, ok := h.IncrementalObjects[t]
-		if ok && o.Snapshot != "" {
-			req.client.Send(o.Snapshot)
-			for _, inc := range o.Increments {
-				req.client.Send(inc)
-			}
+		o, ok := s.incrementalObjects[t]
+		if ok {
+			o.replay(req.client, msg.ScopePublic)
 		}
 	}
 }
 
+// knownScope reports whether the scope is public, private or a prefix of the
+// RBAC configuration.
+func (h *Hub) knownScope(scope string) bool {
+	if scope == msg.ScopePublic || scope == msg.ScopePrivate {
+		return true
+	}
+	_, ok := h.RBAC[scope]
+	return ok
+}
+
 func (h *Hub) premittedRBAC(prefix string, auth Auth) bool {
 	rbac := h.RBAC[prefix]
 
@@ -430,52 +854,68 @@ func (h *Hub) subscribePrefixed(prefixed string, req *Request) {
 
 	if !h.premittedRBAC(prefix, req.client.GetAuth()) {
 		req.client.Send(responseMust(nil, map[string]interface{}{
-			"message": "cannot subscribe to " + prefixed,
+			"message": "cannot subscribe to " + streamName(prefix, t),
 		}))
 
 		return
 	}
 
-	topics, ok := h.PrefixedTopics[prefix]
+	s := h.shardFor(t)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topics, ok := s.prefixedTopics[prefix]
 	if !ok {
-		topics := make(map[string]*Topic, 0)
-		h.PrefixedTopics[prefix] = topics
+		topics = make(map[string]*Topic, 0)
+		s.prefixedTopics[prefix] = topics
 	}
 
 	topic, ok := topics[t]
 	if !ok {
 		topic = NewTopic(h)
-		h.PrefixedTopics[prefix][t] = topic
+		topic.scope = prefix
+		topics[t] = topic
 	}
 
-	if topic.subscribe(req.client) {
+	if !topic.has(req.client) && !req.historyQueued(topic) {
 		metrics.RecordHubSubscription("prefixed", prefixed)
-		req.client.SubscribePublic(prefixed)
+		req.client.SubscribePublic(streamName(prefix, t))
+
+		if !s.queueHistory(prefix, prefixed, t, topic, req) {
+			topic.subscribe(req.client)
+			s.queueLastValue(h.LastValues, prefix, prefixed, t, topic, req)
+		}
 	}
 
 	if isIncrementObject(t) {
-		o, ok := h.IncrementalObjects[t]
-		if ok && o.Snapshot != "" {
-			req.client.Send(o.Snapshot)
-			for _, inc := range o.Increments {
-				req.client.Send(inc)
-			}
+		o, ok := s.prefixedObjects[prefix][t]
+		if ok {
+			o.replay(req.client, prefix)
 		}
 	}
 }
 
 func (h *Hub) handleSubscribe(req *Request) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
 	for _, t := range req.Streams {
+		n, err := msg.ParseStreamName(t)
+
 		switch {
-		case isPrivateStream(t):
-			h.subscribePrivate(t, req)
-		case isPrefixedStream(t):
-			h.subscribePrefixed(t, req)
+		case err != nil:
+			req.client.Send(responseMust(err, nil))
+		case isPattern(t):
+			h.subscribePattern(t, req)
+		case msg.StreamBase(n.Name) != n.Name && n.Scope != msg.ScopePublic:
+			req.client.Send(responseMust(fmt.Errorf("stream modifiers are only supported on public streams: %s", t), nil))
+		case strings.Contains(t, ":") && !h.knownScope(n.Scope):
+			// The legacy names of unknown prefixes are refused by
+			// subscribePrefixed
+			req.client.Send(responseMust(fmt.Errorf("unknown stream scope %s: %s", n.Scope, t), nil))
+		case n.Scope == msg.ScopePrivate:
+			h.subscribePrivate(n.Name, req)
+		case n.Scope == msg.ScopePublic:
+			h.subscribePublic(n.Name, req)
 		default:
-			h.subscribePublic(t, req)
+			h.subscribePrefixed(n.Scope+"."+n.Name, req)
 		}
 	}
 
@@ -483,6 +923,9 @@ func (h *Hub) handleSubscribe(req *Request) {
 		"message": "subscribed",
 		"streams": req.client.GetSubscriptions(),
 	}))
+
+	h.sendHistory(req)
+	h.sendLastValues(req)
 }
 
 func (h *Hub) unsubscribePrivate(t string, req *Request) {
@@ -490,7 +933,12 @@ func (h *Hub) unsubscribePrivate(t string, req *Request) {
 	if uid == "" {
 		return
 	}
-	uTopics, ok := h.PrivateTopics[uid]
+
+	s := h.shardFor(uid)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	uTopics, ok := s.privateTopics[uid]
 	if !ok {
 		return
 	}
@@ -499,7 +947,7 @@ func (h *Hub) unsubscribePrivate(t string, req *Request) {
 	if ok {
 		if topic.unsubscribe(req.client) {
 			metrics.RecordHubUnsubscription("private", t)
-			req.client.UnsubscribePrivate(t)
+			req.client.UnsubscribePrivate(streamName(msg.ScopePrivate, t))
 		}
 
 		if topic.len() == 0 {
@@ -507,15 +955,19 @@ func (h *Hub) unsubscribePrivate(t string, req *Request) {
 		}
 	}
 
-	uTopics, ok = h.PrivateTopics[uid]
-	if ok && len(uTopics) == 0 {
-		delete(h.PrivateTopics, uid)
+	if len(uTopics) == 0 {
+		delete(s.privateTopics, uid)
 	}
 }
 
 func (h *Hub) unsubscribePrefixed(prefixed string, req *Request) {
 	scope, t := splitPrefixedTopic(prefixed)
-	topics, ok := h.PrefixedTopics[scope]
+
+	s := h.shardFor(t)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topics, ok := s.prefixedTopics[scope]
 	if !ok {
 		return
 	}
@@ -523,44 +975,59 @@ func (h *Hub) unsubscribePrefixed(prefixed string, req *Request) {
 	topic, ok := topics[t]
 	if ok {
 		if topic.unsubscribe(req.client) {
-			metrics.RecordHubUnsubscription("prefixed", t)
-			req.client.UnsubscribePublic(t)
+			metrics.RecordHubUnsubscription("prefixed", prefixed)
+			req.client.UnsubscribePublic(streamName(scope, t))
 		}
 
 		if topic.len() == 0 {
 			delete(topics, t)
-			h.PrefixedTopics[scope] = topics
 		}
 	}
+
+	if len(topics) == 0 {
+		delete(s.prefixedTopics, scope)
+	}
 }
 
 func (h *Hub) unsubscribePublic(t string, req *Request) {
-	topic, ok := h.PublicTopics[t]
+	s := h.shardFor(msg.StreamBase(t))
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topic, ok := s.publicTopics[t]
 	if ok {
 		if topic.unsubscribe(req.client) {
 			metrics.RecordHubUnsubscription("public", t)
-			req.client.UnsubscribePublic(t)
+			req.client.UnsubscribePublic(streamName(msg.ScopePublic, t))
 		}
 
 		if topic.len() == 0 {
-			delete(h.PublicTopics, t)
+			s.deletePublicTopic(t, topic)
 		}
 	}
 }
 
-func (h *Hub) handleUnsubscribe(req *Request) {
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
+func (h *Hub) unsubscribeStream(t string, n msg.StreamName, req *Request) {
+	switch {
+	case isPattern(t):
+		h.unsubscribePattern(t, req)
+	case n.Scope == msg.ScopePrivate:
+		h.unsubscribePrivate(n.Name, req)
+	case n.Scope == msg.ScopePublic:
+		h.unsubscribePublic(n.Name, req)
+	default:
+		h.unsubscribePrefixed(n.Scope+"."+n.Name, req)
+	}
+}
 
+func (h *Hub) handleUnsubscribe(req *Request) {
 	for _, t := range req.Streams {
-		switch {
-		case isPrivateStream(t):
-			h.unsubscribePrivate(t, req)
-		case isPrefixedStream(t):
-			h.unsubscribePrefixed(t, req)
-		default:
-			h.unsubscribePublic(t, req)
+		n, err := msg.ParseStreamName(t)
+		if err != nil {
+			req.client.Send(responseMust(err, nil))
+			continue
 		}
+		h.unsubscribeStream(t, n, req)
 	}
 
 	req.client.Send(responseMust(nil, map[string]interface{}{
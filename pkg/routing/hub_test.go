@@ -1,9 +1,17 @@
 package routing
 
 import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/openware/rango/pkg/message"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -11,6 +19,8 @@ import (
 
 type MockedClient struct {
 	mock.Mock
+
+	session bool
 }
 
 func (c *MockedClient) Send(m string) {
@@ -20,11 +30,19 @@ func (c *MockedClient) Send(m string) {
 func (c *MockedClient) Close() {
 }
 
+func (c *MockedClient) sessionRequested() bool {
+	return c.session
+}
+
 func (c *MockedClient) GetAuth() Auth {
 	args := c.Called()
 	return args.Get(0).(Auth)
 }
 
+func (c *MockedClient) SetAuth(auth Auth) {
+	c.Called(auth)
+}
+
 func (c *MockedClient) GetSubscriptions() []string {
 	args := c.Called()
 	return args.Get(0).([]string)
@@ -46,6 +64,30 @@ func (c *MockedClient) UnsubscribePrivate(s string) {
 	c.Called(s)
 }
 
+func publicTopicsCount(h *Hub) int {
+	n := 0
+	for _, s := range h.shards {
+		n += len(s.publicTopics)
+	}
+	return n
+}
+
+func privateTopicsCount(h *Hub) int {
+	n := 0
+	for _, s := range h.shards {
+		n += len(s.privateTopics)
+	}
+	return n
+}
+
+func incrementalObjectsCount(h *Hub) int {
+	n := 0
+	for _, s := range h.shards {
+		n += len(s.incrementalObjects)
+	}
+	return n
+}
+
 func setup(c *MockedClient, streams []string) *Hub {
 	h := NewHub(nil)
 	h.handleSubscribe(&Request{
@@ -80,16 +122,16 @@ func TestAnonymous(t *testing.T) {
 		c.On("Send", `{"success":{"message":"subscribed","streams":["`+streams[0]+`"]}}`).Return()
 
 		h := setup(c, streams)
-		assert.Equal(t, 1, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 1, publicTopicsCount(h))
+		assert.Equal(t, 0, privateTopicsCount(h))
 
 		c.On("UnsubscribePublic", streams[0]).Return()
 		c.On("GetSubscriptions").Return([]string{}).Once()
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, streams)
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, publicTopicsCount(h))
+		assert.Equal(t, 0, privateTopicsCount(h))
 	})
 
 	t.Run("subscribe to multiple public streams", func(t *testing.T) {
@@ -110,8 +152,8 @@ func TestAnonymous(t *testing.T) {
 			"eurusd.updates",
 		})
 
-		assert.Equal(t, 2, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 2, publicTopicsCount(h))
+		assert.Equal(t, 0, privateTopicsCount(h))
 
 		c.On("UnsubscribePublic", streams[0]).Return().Once()
 		c.On("UnsubscribePublic", streams[1]).Return().Once()
@@ -119,8 +161,8 @@ func TestAnonymous(t *testing.T) {
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, streams)
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, publicTopicsCount(h))
+		assert.Equal(t, 0, privateTopicsCount(h))
 
 	})
 
@@ -136,8 +178,8 @@ func TestAnonymous(t *testing.T) {
 			"trades",
 		})
 
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, publicTopicsCount(h))
+		assert.Equal(t, 0, privateTopicsCount(h))
 	})
 }
 func TestAuthenticated(t *testing.T) {
@@ -152,16 +194,16 @@ func TestAuthenticated(t *testing.T) {
 		h := setup(c, []string{
 			"trades",
 		})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 1, len(h.PrivateTopics))
+		assert.Equal(t, 0, publicTopicsCount(h))
+		assert.Equal(t, 1, privateTopicsCount(h))
 
 		c.On("UnsubscribePrivate", "trades").Return().Once()
 		c.On("GetSubscriptions").Return([]string{}).Once()
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, []string{"trades"})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, publicTopicsCount(h))
+		assert.Equal(t, 0, privateTopicsCount(h))
 	})
 
 	t.Run("subscribe to multiple private streams", func(t *testing.T) {
@@ -174,10 +216,10 @@ func TestAuthenticated(t *testing.T) {
 		c.On("Send", `{"success":{"message":"subscribed","streams":["trades","orders"]}}`).Return()
 
 		h := setup(c, []string{"trades", "orders"})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 1, len(h.PrivateTopics))
+		assert.Equal(t, 0, publicTopicsCount(h))
+		assert.Equal(t, 1, privateTopicsCount(h))
 
-		uTopics, ok := h.PrivateTopics["UIDABC00001"]
+		uTopics, ok := h.shardFor("UIDABC00001").privateTopics["UIDABC00001"]
 		require.True(t, ok)
 		assert.Equal(t, 2, len(uTopics))
 
@@ -187,8 +229,8 @@ func TestAuthenticated(t *testing.T) {
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, []string{"trades", "orders"})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, publicTopicsCount(h))
+		assert.Equal(t, 0, privateTopicsCount(h))
 
 	})
 
@@ -203,10 +245,10 @@ func TestAuthenticated(t *testing.T) {
 		c.On("Send", `{"success":{"message":"subscribed","streams":["trades","orders","eurusd.updates"]}}`).Return()
 
 		h := setup(c, []string{"trades", "orders", "eurusd.updates"})
-		assert.Equal(t, 1, len(h.PublicTopics))
-		assert.Equal(t, 1, len(h.PrivateTopics))
+		assert.Equal(t, 1, publicTopicsCount(h))
+		assert.Equal(t, 1, privateTopicsCount(h))
 
-		uTopics, ok := h.PrivateTopics["UIDABC00001"]
+		uTopics, ok := h.shardFor("UIDABC00001").privateTopics["UIDABC00001"]
 		require.True(t, ok)
 		assert.Equal(t, 2, len(uTopics))
 
@@ -217,8 +259,8 @@ func TestAuthenticated(t *testing.T) {
 		c.On("Send", `{"success":{"message":"unsubscribed","streams":[]}}`).Return()
 
 		teardown(h, c, []string{"trades", "orders", "eurusd.updates"})
-		assert.Equal(t, 0, len(h.PublicTopics))
-		assert.Equal(t, 0, len(h.PrivateTopics))
+		assert.Equal(t, 0, publicTopicsCount(h))
+		assert.Equal(t, 0, privateTopicsCount(h))
 	})
 }
 
@@ -262,6 +304,53 @@ func TestHandleMessage(t *testing.T) {
 	c.AssertExpectations(t)
 }
 
+func TestExplicitScopes(t *testing.T) {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+	c := &MockedClient{}
+	c.On("GetAuth").Return(Auth{UID: "UID123", Role: "admin"})
+	c.On("GetSubscriptions").Return([]string{})
+	c.On("SubscribePublic", mock.Anything).Return()
+	c.On("SubscribePrivate", mock.Anything).Return()
+	c.On("UnsubscribePublic", mock.Anything).Return()
+	c.On("Send", mock.Anything).Return()
+
+	h.handleSubscribe(&Request{
+		client: c,
+		Request: message.Request{
+			Streams: []string{"public:eur.usd.trades", "public:tickers", "private:order", "admin:eur.usd.sys", "private:order@20", "global:tickers"},
+		},
+	})
+	c.AssertCalled(t, "SubscribePublic", "public:eur.usd.trades")
+	c.AssertCalled(t, "SubscribePublic", "public:tickers")
+	c.AssertCalled(t, "SubscribePrivate", "order")
+	c.AssertCalled(t, "SubscribePublic", "admin:eur.usd.sys")
+
+	h.routeMessage(&Event{Scope: "public", Stream: "eur.usd", Type: "trades", Topic: "eur.usd.trades", Body: 1})
+	h.routeMessage(&Event{Scope: "public", Stream: "global", Type: "tickers", Topic: "tickers", Body: 2})
+	h.routeMessage(&Event{Scope: "private", Stream: "UID123", Type: "order", Topic: "order", Body: 3})
+	h.routeMessage(&Event{Scope: "admin", Stream: "eur.usd", Type: "sys", Topic: "eur.usd.sys", Body: 4})
+
+	assert.Equal(t, []string{
+		`{"error":"stream modifiers are only supported on public streams: private:order@20"}`,
+		`{"error":"unknown stream scope global: global:tickers"}`,
+		`{"success":{"message":"subscribed","streams":[]}}`,
+		`{"eur.usd.trades":1}`,
+		`{"tickers":2}`,
+		`{"order":3}`,
+		`{"eur.usd.sys":4}`,
+	}, sentMessages(c))
+
+	h.handleUnsubscribe(&Request{
+		client: c,
+		Request: message.Request{
+			Streams: []string{"public:eur.usd.trades", "admin:eur.usd.sys", "public:"},
+		},
+	})
+	c.AssertCalled(t, "UnsubscribePublic", "public:eur.usd.trades")
+	c.AssertCalled(t, "UnsubscribePublic", "admin:eur.usd.sys")
+	assert.Contains(t, sentMessages(c), `{"error":"Could not parse stream public:: missing name"}`)
+}
+
 func TestIncrementalObjectStorage(t *testing.T) {
 	h := NewHub(nil)
 
@@ -277,7 +366,7 @@ func TestIncrementalObjectStorage(t *testing.T) {
 		},
 	})
 
-	require.Equal(t, 0, len(h.IncrementalObjects))
+	require.Equal(t, 0, incrementalObjectsCount(h))
 
 	// Initial snapshot
 	h.routeMessage(&Event{
@@ -291,9 +380,9 @@ func TestIncrementalObjectStorage(t *testing.T) {
 		},
 	})
 
-	require.Equal(t, 1, len(h.IncrementalObjects))
+	require.Equal(t, 1, incrementalObjectsCount(h))
 
-	o, ok := h.IncrementalObjects["abc.count-inc"]
+	o, ok := h.shardFor("abc.count-inc").incrementalObjects["abc.count-inc"]
 	require.True(t, ok)
 	require.Equal(t, 0, len(o.Increments))
 	require.Equal(t, `{"abc.count-snap":{"data":[2,3,4],"sequence":12}}`, o.Snapshot)
@@ -309,8 +398,8 @@ func TestIncrementalObjectStorage(t *testing.T) {
 			"sequence": 13,
 		},
 	})
-	require.Equal(t, 1, len(h.IncrementalObjects))
-	o, ok = h.IncrementalObjects["abc.count-inc"]
+	require.Equal(t, 1, incrementalObjectsCount(h))
+	o, ok = h.shardFor("abc.count-inc").incrementalObjects["abc.count-inc"]
 	require.True(t, ok)
 	require.Equal(t, 1, len(o.Increments))
 	require.Equal(t, `{"abc.count-snap":{"data":[2,3,4],"sequence":12}}`, o.Snapshot)
@@ -327,8 +416,8 @@ func TestIncrementalObjectStorage(t *testing.T) {
 			"sequence": 14,
 		},
 	})
-	require.Equal(t, 1, len(h.IncrementalObjects))
-	o, ok = h.IncrementalObjects["abc.count-inc"]
+	require.Equal(t, 1, incrementalObjectsCount(h))
+	o, ok = h.shardFor("abc.count-inc").incrementalObjects["abc.count-inc"]
 	require.True(t, ok)
 	require.Equal(t, 2, len(o.Increments))
 	require.Equal(t, `{"abc.count-snap":{"data":[2,3,4],"sequence":12}}`, o.Snapshot)
@@ -347,9 +436,502 @@ func TestIncrementalObjectStorage(t *testing.T) {
 		},
 	})
 
-	require.Equal(t, 1, len(h.IncrementalObjects))
-	o, ok = h.IncrementalObjects["abc.count-inc"]
+	require.Equal(t, 1, incrementalObjectsCount(h))
+	o, ok = h.shardFor("abc.count-inc").incrementalObjects["abc.count-inc"]
 	require.True(t, ok)
 	require.Equal(t, 0, len(o.Increments))
 	require.Equal(t, `{"abc.count-snap":{"data":[2,3,4,5,6],"sequence":14}}`, o.Snapshot)
 }
+
+func TestReceiveMsgDispatch(t *testing.T) {
+	h := NewHub(nil)
+	c := &MockedClient{}
+	received := make(chan string, 2)
+	forward := func(args mock.Arguments) {
+		received <- args.String(0)
+	}
+	c.On("GetAuth").Return(Auth{UID: "UIDABC00001"})
+	c.On("SubscribePublic", "abc.ticker").Return()
+	c.On("SubscribePrivate", "order").Return()
+	c.On("Send", `{"abc.ticker":{"some":"data"}}`).Run(forward).Return().Once()
+	c.On("Send", `{"order":{"id":1}}`).Run(forward).Return().Once()
+
+	h.subscribePublic("abc.ticker", &Request{client: c})
+	h.subscribePrivate("order", &Request{client: c})
+
+	h.ReceiveMsg(amqp.Delivery{RoutingKey: "public.abc.ticker", Body: []byte(`{"some":"data"}`)})
+	h.ReceiveMsg(amqp.Delivery{RoutingKey: "private.UIDABC00001.order", Body: []byte(`{"id":1}`)})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("message not routed")
+		}
+	}
+	c.AssertExpectations(t)
+}
+
+func TestShardFor(t *testing.T) {
+	h := NewHub(nil)
+
+	assert.Same(t, h.shardFor("eurusd.trades"), h.shardFor("eurusd.trades"))
+	assert.Same(t, h.shardFor("eurusd.ob-inc"), h.shardFor(eventShardKey(&Event{
+		Scope: "admin",
+		Topic: "eurusd.ob-inc",
+	})))
+	assert.Same(t, h.shardFor("UIDABC00001"), h.shardFor(eventShardKey(&Event{
+		Scope:  "private",
+		Stream: "UIDABC00001",
+		Topic:  "order",
+	})))
+}
+
+func TestPrefixedIncrementalObjects(t *testing.T) {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+
+	book := func(scope, typ string, body map[string]interface{}) *Event {
+		return &Event{Scope: scope, Stream: "eurusd", Type: typ, Topic: "eurusd.ob-inc", Body: body}
+	}
+
+	// An increment of a scope without snapshot is not applied to the public book
+	h.routeMessage(book("public", "ob-snap", map[string]interface{}{"asks": [][]string{{"1.0", "1"}}, "sequence": 1}))
+	h.routeMessage(book("admin", "ob-inc", map[string]interface{}{"asks": [][]string{{"1.0", "9"}}, "sequence": 2}))
+	h.routeMessage(book("admin", "ob-snap", map[string]interface{}{"asks": [][]string{{"2.0", "2"}}, "sequence": 5}))
+
+	admin := &MockedClient{}
+	admin.On("GetAuth").Return(Auth{Role: "admin"})
+	admin.On("SubscribePublic", "admin.eurusd.ob-inc").Return()
+	admin.On("UnsubscribePublic", "admin.eurusd.ob-inc").Return()
+	admin.On("Send", mock.Anything).Return()
+	h.subscribePrefixed("admin.eurusd.ob-inc", &Request{client: admin})
+
+	public := &MockedClient{}
+	public.On("SubscribePublic", "eurusd.ob-inc").Return()
+	public.On("Send", mock.Anything).Return()
+	h.subscribePublic("eurusd.ob-inc", &Request{client: public})
+
+	h.routeMessage(book("admin", "ob-inc", map[string]interface{}{"asks": [][]string{{"2.0", "3"}}, "sequence": 6}))
+	h.routeMessage(book("public", "ob-inc", map[string]interface{}{"asks": [][]string{{"1.0", "4"}}, "sequence": 2}))
+
+	assert.Equal(t, []string{
+		`{"eurusd.ob-snap":{"asks":[["2.0","2"]],"bids":[],"sequence":5}}`,
+		`{"eurusd.ob-inc":{"asks":[["2.0","3"]],"sequence":6}}`,
+	}, sentMessages(admin))
+	assert.Equal(t, []string{
+		`{"eurusd.ob-snap":{"asks":[["1.0","1"]],"bids":[],"sequence":1}}`,
+		`{"eurusd.ob-inc":{"asks":[["1.0","4"]],"sequence":2}}`,
+	}, sentMessages(public))
+
+	s := h.shardFor("eurusd.ob-inc")
+	assert.Equal(t, int64(6), s.prefixedObjects["admin"]["eurusd.ob-inc"].Book.Sequence)
+	assert.Equal(t, int64(2), s.incrementalObjects["eurusd.ob-inc"].Book.Sequence)
+
+	t.Run("unsubscribe a prefixed stream", func(t *testing.T) {
+		h.unsubscribePrefixed("admin.eurusd.ob-inc", &Request{client: admin})
+		admin.AssertCalled(t, "UnsubscribePublic", "admin.eurusd.ob-inc")
+		assert.Empty(t, s.prefixedTopics)
+		assert.Contains(t, s.prefixedObjects, "admin")
+	})
+}
+
+type benchClient struct {
+	auth Auth
+}
+
+func (c *benchClient) Send(string)                {}
+func (c *benchClient) Close()                     {}
+func (c *benchClient) GetAuth() Auth              { return c.auth }
+func (c *benchClient) SetAuth(a Auth)             { c.auth = a }
+func (c *benchClient) GetSubscriptions() []string { return nil }
+func (c *benchClient) SubscribePublic(string)     {}
+func (c *benchClient) SubscribePrivate(string)    {}
+func (c *benchClient) UnsubscribePublic(string)   {}
+func (c *benchClient) UnsubscribePrivate(string)  {}
+
+func benchmarkHub(topics []string, subscribers int) *Hub {
+	log.Logger = log.Logger.Level(zerolog.InfoLevel)
+	h := NewHub(nil)
+	for _, t := range topics {
+		for i := 0; i < subscribers; i++ {
+			h.subscribePublic(t, &Request{client: &benchClient{}})
+		}
+	}
+	return h
+}
+
+// BenchmarkRouteMessageSingleTopic routes every message to the same topic,
+// all the goroutines contend on the same shard.
+func BenchmarkRouteMessageSingleTopic(b *testing.B) {
+	h := benchmarkHub([]string{"eurusd.trades"}, 100)
+
+	b.RunParallel(func(pb *testing.PB) {
+		msg := &Event{
+			Scope:  "public",
+			Stream: "eurusd",
+			Type:   "trades",
+			Topic:  "eurusd.trades",
+			Body:   map[string]interface{}{"price": "1.0"},
+		}
+		for pb.Next() {
+			h.routeMessage(msg)
+		}
+	})
+}
+
+// BenchmarkRouteMessageManyTopics routes messages to distinct topics, the
+// throughput should scale with the number of cores (go test -cpu 1,2,4,8).
+func BenchmarkRouteMessageManyTopics(b *testing.B) {
+	markets := make([]string, 256)
+	topics := make([]string, len(markets))
+	for i := range markets {
+		markets[i] = fmt.Sprintf("market%d", i)
+		topics[i] = markets[i] + ".trades"
+	}
+	h := benchmarkHub(topics, 100)
+
+	var n uint32
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		offset := int(atomic.AddUint32(&n, 1)) * 17
+		for pb.Next() {
+			k := (offset + i) % len(markets)
+			h.routeMessage(&Event{
+				Scope:  "public",
+				Stream: markets[k],
+				Type:   "trades",
+				Topic:  topics[k],
+				Body:   map[string]interface{}{"price": "1.0"},
+			})
+			i++
+		}
+	})
+}
+
+// BenchmarkRouteMessageWithSubscriptions measures routing while other
+// goroutines keep subscribing and unsubscribing on unrelated topics.
+func BenchmarkRouteMessageWithSubscriptions(b *testing.B) {
+	h := benchmarkHub([]string{"eurusd.ob-inc"}, 1000)
+	h.routeMessage(&Event{
+		Scope:  "public",
+		Stream: "eurusd",
+		Type:   "ob-snap",
+		Topic:  "eurusd.ob-inc",
+		Body:   map[string]interface{}{"sequence": 1},
+	})
+
+	b.RunParallel(func(pb *testing.PB) {
+		c := &benchClient{}
+		req := &Request{client: c, Request: message.Request{Streams: []string{"btcusd.trades"}}}
+		i := 0
+		for pb.Next() {
+			if i%2 == 0 {
+				h.routeMessage(&Event{
+					Scope:  "public",
+					Stream: "eurusd",
+					Type:   "ob-inc",
+					Topic:  "eurusd.ob-inc",
+					Body:   map[string]interface{}{"sequence": i},
+				})
+			} else {
+				h.handleSubscribe(req)
+				h.handleUnsubscribe(req)
+			}
+			i++
+		}
+	})
+}
+
+// benchmarkPipeline measures AMQP messages going through the hub, from their
+// decoding to the outbound queues of the subscribers. The setup messages are
+// routed before the measure.
+func benchmarkPipeline(b *testing.B, key string, body func(i int) []byte, setup ...amqp.Delivery) {
+	log.Logger = log.Logger.Level(zerolog.InfoLevel)
+	h := NewHub(nil)
+
+	for _, d := range setup {
+		msg, err := h.newEvent(d)
+		require.NoError(b, err)
+		h.routeMessage(msg)
+	}
+
+	msg, err := h.newEvent(amqp.Delivery{RoutingKey: key, Body: body(0)})
+	require.NoError(b, err)
+
+	clients := make([]*Client, 100)
+	for i := range clients {
+		clients[i] = &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil)}
+		h.subscribePublic(msg.Topic, &Request{client: clients[i]})
+		for _, ok := clients[i].send.pop(); ok; _, ok = clients[i].send.pop() {
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, err := h.newEvent(amqp.Delivery{RoutingKey: key, Body: body(i)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		h.routeMessage(msg)
+
+		for _, c := range clients {
+			if _, ok := c.send.pop(); !ok {
+				b.Fatal("message not queued")
+			}
+		}
+	}
+}
+
+func BenchmarkPipelineTrades(b *testing.B) {
+	benchmarkPipeline(b, "public.eurusd.trades", func(int) []byte {
+		return []byte(`[{"tid":1234567,"taker_type":"buy","date":1600000000,"price":"9123.45","amount":"0.0123"},` +
+			`{"tid":1234568,"taker_type":"sell","date":1600000001,"price":"9123.40","amount":"1.5"}]`)
+	})
+}
+
+func BenchmarkPipelineOrderBook(b *testing.B) {
+	body := func(seq int) []byte {
+		return []byte(`{"asks":[["9123.45","0.1"],["9124.00","2"]],"bids":[["9120.10","0"]],"sequence":` + strconv.Itoa(seq) + `}`)
+	}
+
+	benchmarkPipeline(b, "public.eurusd.ob-inc", func(i int) []byte { return body(i + 2) }, amqp.Delivery{
+		RoutingKey: "public.eurusd.ob-snap",
+		Body:       []byte(`{"asks":[["9123.45","1"]],"bids":[["9120.10","1"]],"sequence":1}`),
+	})
+}
+
+func TestOrderBookObjectStorage(t *testing.T) {
+	h := NewHub(nil)
+
+	h.routeMessage(&Event{
+		Scope:  "public",
+		Stream: "eurusd",
+		Type:   "ob-snap",
+		Topic:  "eurusd.ob-inc",
+		Body: map[string]interface{}{
+			"asks":     [][]string{{"1020.0", "0.005"}, {"1026.0", "0.03"}},
+			"bids":     [][]string{{"1000.0", "0.25"}, {"999.0", "0.005"}},
+			"sequence": 10,
+		},
+	})
+
+	o, ok := h.shardFor("eurusd.ob-inc").incrementalObjects["eurusd.ob-inc"]
+	require.True(t, ok)
+	require.NotNil(t, o.Book)
+	require.Equal(t, "", o.Snapshot)
+
+	for i, body := range []map[string]interface{}{
+		{"asks": [][]string{{"1020.0", "0.015"}}, "sequence": 11},
+		{"bids": [][]string{{"1000.0", ""}, {"1001.0", "1"}}, "sequence": 12},
+		{"asks": [][]string{{"1026.0", "0"}}, "sequence": 13},
+	} {
+		h.routeMessage(&Event{
+			Scope:  "public",
+			Stream: "eurusd",
+			Type:   "ob-inc",
+			Topic:  "eurusd.ob-inc",
+			Body:   body,
+		})
+		require.Equal(t, 0, len(o.Increments), "increment %d", i)
+	}
+
+	c := &MockedClient{}
+	c.On("SubscribePublic", "eurusd.ob-inc").Return()
+	c.On("Send", `{"eurusd.ob-snap":{"asks":[["1020.0","0.015"]],"bids":[["1001.0","1"],["999.0","0.005"]],"sequence":13}}`).Return().Once()
+	h.subscribePublic("eurusd.ob-inc", &Request{client: c})
+	c.AssertExpectations(t)
+
+	t.Run("invalid increment falls back to replay until the next snapshot", func(t *testing.T) {
+		p := &fakePublisher{pushes: make(chan pushed, 10)}
+		h.SnapshotRequester = NewSnapshotRequester(p, "peatio.events.snapshots", "snapshot.request", time.Second)
+		defer func() { h.SnapshotRequester = nil }()
+
+		inc := `{"eurusd.ob-inc":{"asks":[["bad","1"]],"sequence":14}}`
+		c.On("Send", inc).Return().Once()
+		h.routeMessage(&Event{
+			Scope:  "public",
+			Stream: "eurusd",
+			Type:   "ob-inc",
+			Topic:  "eurusd.ob-inc",
+			Body:   map[string]interface{}{"asks": [][]string{{"bad", "1"}}, "sequence": 14},
+		})
+		c.AssertExpectations(t)
+		assert.Equal(t, "snapshot.request", p.next(t).routingKey)
+
+		require.Equal(t, 1, incrementalObjectsCount(h))
+		require.Nil(t, o.Book)
+		require.Equal(t, `{"eurusd.ob-snap":{"asks":[["1020.0","0.015"]],"bids":[["1001.0","1"],["999.0","0.005"]],"sequence":13}}`, o.Snapshot)
+		require.Equal(t, []string{inc}, o.Increments)
+
+		// The next increments are still delivered
+		inc = `{"eurusd.ob-inc":{"asks":[["1020.0","0.02"]],"sequence":15}}`
+		c.On("Send", inc).Return().Once()
+		h.routeMessage(&Event{
+			Scope:  "public",
+			Stream: "eurusd",
+			Type:   "ob-inc",
+			Topic:  "eurusd.ob-inc",
+			Body:   map[string]interface{}{"asks": [][]string{{"1020.0", "0.02"}}, "sequence": 15},
+		})
+		c.AssertExpectations(t)
+		require.Len(t, o.Increments, 2)
+	})
+
+	t.Run("unrecognized snapshot falls back to replay", func(t *testing.T) {
+		h.routeMessage(&Event{
+			Scope:  "public",
+			Stream: "eurusd",
+			Type:   "ob-snap",
+			Topic:  "eurusd.ob-inc",
+			Body:   []interface{}{1, 2},
+		})
+		o, ok := h.shardFor("eurusd.ob-inc").incrementalObjects["eurusd.ob-inc"]
+		require.True(t, ok)
+		require.Nil(t, o.Book)
+		require.Equal(t, `{"eurusd.ob-snap":[1,2]}`, o.Snapshot)
+	})
+}
+
+func sentMessages(c *MockedClient) []string {
+	sent := []string{}
+	for _, call := range c.Calls {
+		if call.Method == "Send" {
+			sent = append(sent, call.Arguments.String(0))
+		}
+	}
+	return sent
+}
+
+func countEvent(typ string, seq int) *Event {
+	return &Event{
+		Scope:  "public",
+		Stream: "abc",
+		Type:   typ,
+		Topic:  "abc.count-inc",
+		Body: map[string]interface{}{
+			"data":     seq * 10,
+			"sequence": seq,
+		},
+	}
+}
+
+func TestSequenceGap(t *testing.T) {
+	h := NewHub(nil)
+	h.routeMessage(countEvent("count-snap", 10))
+
+	c := &MockedClient{}
+	c.On("SubscribePublic", "abc.count-inc").Return()
+	c.On("Send", mock.Anything).Return()
+	h.subscribePublic("abc.count-inc", &Request{client: c})
+
+	o := h.shardFor("abc.count-inc").incrementalObjects["abc.count-inc"]
+	require.Equal(t, int64(10), o.Sequence)
+
+	h.routeMessage(countEvent("count-inc", 11))
+	h.routeMessage(countEvent("count-inc", 11)) // duplicate
+	h.routeMessage(countEvent("count-inc", 10)) // out of order
+	require.False(t, o.Stale)
+	require.Equal(t, 1, len(o.Increments))
+
+	h.routeMessage(countEvent("count-inc", 13)) // gap
+	require.True(t, o.Stale)
+	h.routeMessage(countEvent("count-inc", 14))
+	require.Equal(t, 1, len(o.Increments))
+	require.Equal(t, 2, len(o.held))
+
+	assert.Equal(t, []string{
+		`{"abc.count-snap":{"data":100,"sequence":10}}`,
+		`{"abc.count-inc":{"data":110,"sequence":11}}`,
+		`{"resync":{"sequence":11,"stream":"abc.count-inc"}}`,
+	}, sentMessages(c))
+
+	// A client subscribing during the gap is asked to resync instead of
+	// receiving the stale state
+	c2 := &MockedClient{}
+	c2.On("SubscribePublic", "abc.count-inc").Return()
+	c2.On("Send", mock.Anything).Return()
+	h.subscribePublic("abc.count-inc", &Request{client: c2})
+	assert.Equal(t, []string{`{"resync":{"sequence":11,"stream":"abc.count-inc"}}`}, sentMessages(c2))
+
+	// The new snapshot is sent to the subscribers with the held increments
+	h.routeMessage(countEvent("count-snap", 13))
+	require.False(t, o.Stale)
+	require.Equal(t, 0, len(o.held))
+	require.Equal(t, int64(14), o.Sequence)
+
+	assert.Equal(t, []string{
+		`{"abc.count-snap":{"data":100,"sequence":10}}`,
+		`{"abc.count-inc":{"data":110,"sequence":11}}`,
+		`{"resync":{"sequence":11,"stream":"abc.count-inc"}}`,
+		`{"abc.count-snap":{"data":130,"sequence":13}}`,
+		`{"abc.count-inc":{"data":140,"sequence":14}}`,
+	}, sentMessages(c))
+
+	h.routeMessage(countEvent("count-inc", 15))
+	assert.Equal(t, `{"abc.count-inc":{"data":150,"sequence":15}}`, sentMessages(c)[5])
+	assert.Equal(t, []string{
+		`{"resync":{"sequence":11,"stream":"abc.count-inc"}}`,
+		`{"abc.count-snap":{"data":130,"sequence":13}}`,
+		`{"abc.count-inc":{"data":140,"sequence":14}}`,
+		`{"abc.count-inc":{"data":150,"sequence":15}}`,
+	}, sentMessages(c2))
+}
+
+func TestEventSequence(t *testing.T) {
+	seq, ok := eventSequence(map[string]interface{}{"sequence": float64(12)})
+	assert.True(t, ok)
+	assert.Equal(t, int64(12), seq)
+
+	_, ok = eventSequence(map[string]interface{}{"asks": []interface{}{}})
+	assert.False(t, ok)
+
+	_, ok = eventSequence([]interface{}{1, 2})
+	assert.False(t, ok)
+
+	seq, ok = eventSequence(json.RawMessage(`{"asks":[],"sequence":12}`))
+	assert.True(t, ok)
+	assert.Equal(t, int64(12), seq)
+
+	_, ok = eventSequence(json.RawMessage(`{"asks":[]}`))
+	assert.False(t, ok)
+
+	_, ok = eventSequence(json.RawMessage(`[1,2]`))
+	assert.False(t, ok)
+}
+
+func TestOrderBookUpdateDecodedOnce(t *testing.T) {
+	inc := &Event{Type: "ob-inc", Body: json.RawMessage(`{"asks":[["1.0","2"]],"sequence":12}`)}
+	seq, ok := inc.sequence()
+	assert.True(t, ok)
+	assert.Equal(t, int64(12), seq)
+
+	// The update is shared by the book and its views
+	u, err := inc.orderBookUpdate()
+	require.NoError(t, err)
+	inc.Body = json.RawMessage(`{}`)
+	again, err := inc.orderBookUpdate()
+	require.NoError(t, err)
+	assert.Same(t, u, again)
+
+	// Bodies which are not order book updates keep their sequence
+	inc = &Event{Type: "ob-inc", Body: json.RawMessage(`{"asks":"none","sequence":13}`)}
+	seq, ok = inc.sequence()
+	assert.True(t, ok)
+	assert.Equal(t, int64(13), seq)
+
+	_, ok = (&Event{Type: "ob-inc", Body: json.RawMessage(`{"asks":[]}`)}).sequence()
+	assert.False(t, ok)
+}
+
+func TestNewEvent(t *testing.T) {
+	h := NewHub(nil)
+
+	msg, err := h.newEvent(amqp.Delivery{RoutingKey: "public.eurusd.trades", Body: []byte("[\n  {\"tid\": 1, \"price\": \"1.0\"}\n]")})
+	require.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`[{"tid":1,"price":"1.0"}]`), msg.Body)
+	assert.Equal(t, "eurusd.trades", msg.Topic)
+
+	_, err = h.newEvent(amqp.Delivery{RoutingKey: "public.eurusd.trades", Body: []byte(`{"tid":`)})
+	assert.Error(t, err)
+}
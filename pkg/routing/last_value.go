@@ -0,0 +1,134 @@
+package routing
+
+import (
+	"path"
+	"time"
+)
+
+// LastValueCache keeps the last message of the public and prefixed topics of
+// the configured event types. New subscribers receive it right after the
+// subscription confirmation instead of waiting for the next event.
+type LastValueCache struct {
+	// Cached event types, shell patterns such as kline-* are supported
+	types []string
+
+	// Age after which a cached message is dropped, never when zero
+	ttl time.Duration
+
+	now func() time.Time
+}
+
+type lastValue struct {
+	body interface{}
+	time time.Time
+}
+
+// pendingValue is a cached message to send to a new subscriber once the
+// subscription is confirmed.
+type pendingValue struct {
+	shard  *shard
+	topic  *Topic
+	scope  string
+	key    string
+	stream string
+	value  *lastValue
+}
+
+func NewLastValueCache(types []string, ttl time.Duration) *LastValueCache {
+	return &LastValueCache{
+		types: types,
+		ttl:   ttl,
+		now:   time.Now,
+	}
+}
+
+func (c *LastValueCache) cached(typ string) bool {
+	for _, pattern := range c.types {
+		if ok, _ := path.Match(pattern, typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// storeLastValue keeps the message of a non incremental topic, key is the
+// topic name prefixed by its scope for prefixed topics.
+func (s *shard) storeLastValue(c *LastValueCache, key string, msg *Event) {
+	if c == nil || !c.cached(msg.Type) {
+		return
+	}
+
+	s.lastValues[key] = &lastValue{
+		body: msg.Body,
+		time: c.now(),
+	}
+}
+
+// lastValue returns the cached message of the topic unless it expired.
+func (s *shard) lastValue(c *LastValueCache, key string) *lastValue {
+	if c == nil {
+		return nil
+	}
+
+	v, ok := s.lastValues[key]
+	if !ok {
+		return nil
+	}
+
+	if c.ttl > 0 && c.now().Sub(v.time) > c.ttl {
+		delete(s.lastValues, key)
+		return nil
+	}
+
+	return v
+}
+
+// queueLastValue schedules the cached message of the topic for a new
+// subscriber of the stream.
+func (s *shard) queueLastValue(c *LastValueCache, scope, key, stream string, topic *Topic, req *Request) {
+	if isIncrementObject(key) {
+		return
+	}
+
+	if v := s.lastValue(c, key); v != nil {
+		req.lastValues = append(req.lastValues, pendingValue{
+			shard:  s,
+			topic:  topic,
+			scope:  scope,
+			key:    key,
+			stream: stream,
+			value:  v,
+		})
+	}
+}
+
+// sendLastValues sends the cached messages queued during the subscription.
+// A message is skipped if the topic received a new one meanwhile: the
+// subscriber already got it and must not be sent an older value. On
+// throttled streams, it is also skipped if a newer message is pending, the
+// subscriber gets it at the end of the interval.
+func (h *Hub) sendLastValues(req *Request) {
+	for _, p := range req.lastValues {
+		p.shard.mutex.Lock()
+		if p.shard.lastValues[p.key] == p.value {
+			p.send(req.client)
+		}
+		p.shard.mutex.Unlock()
+	}
+	req.lastValues = nil
+}
+
+func (p pendingValue) send(c IClient) {
+	send := func() bool {
+		sendTopic(c, p.scope, p.stream, string(eventMust(p.stream, p.value.body)))
+		return true
+	}
+
+	if conflater := p.topic.conflater; conflater != nil {
+		if !conflater.pending {
+			conflater.replay(c, send)
+		}
+		return
+	}
+	send()
+}
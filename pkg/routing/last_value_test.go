@@ -0,0 +1,96 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func tickerEvent(scope string, last int) *Event {
+	return &Event{
+		Scope:  scope,
+		Stream: "eurusd",
+		Type:   "tickers",
+		Topic:  "eurusd.tickers",
+		Body:   map[string]interface{}{"last": last},
+	}
+}
+
+func TestLastValueCache(t *testing.T) {
+	c := NewLastValueCache([]string{"tickers", "kline-*"}, time.Minute)
+	assert.True(t, c.cached("tickers"))
+	assert.True(t, c.cached("kline-12h"))
+	assert.False(t, c.cached("trades"))
+}
+
+func TestLastValueOnSubscribe(t *testing.T) {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+	h.LastValues = NewLastValueCache([]string{"tickers"}, time.Minute)
+
+	now := time.Now()
+	h.LastValues.now = func() time.Time { return now }
+
+	h.routeMessage(tickerEvent("public", 1))
+	h.routeMessage(tickerEvent("public", 2))
+	h.routeMessage(tickerEvent("admin", 3))
+	h.routeMessage(&Event{
+		Scope:  "public",
+		Stream: "eurusd",
+		Type:   "trades",
+		Topic:  "eurusd.trades",
+		Body:   []interface{}{},
+	})
+
+	subscribe := func(streams ...string) *MockedClient {
+		c := &MockedClient{}
+		c.On("GetAuth").Return(Auth{Role: "admin"})
+		c.On("GetSubscriptions").Return(streams)
+		c.On("SubscribePublic", mock.Anything).Return()
+		c.On("Send", mock.Anything).Return()
+		h.handleSubscribe(&Request{
+			client:  c,
+			Request: message.Request{Streams: streams},
+		})
+		return c
+	}
+
+	c := subscribe("eurusd.tickers", "eurusd.trades", "admin.eurusd.tickers", "eurusd.tickers@1s")
+	assert.Equal(t, []string{
+		`{"success":{"message":"subscribed","streams":["eurusd.tickers","eurusd.trades","admin.eurusd.tickers","eurusd.tickers@1s"]}}`,
+		`{"eurusd.tickers":{"last":2}}`,
+		`{"eurusd.tickers":{"last":3}}`,
+		`{"eurusd.tickers@1s":{"last":2}}`,
+	}, sentMessages(c))
+
+	t.Run("values are not resent to subscribers", func(t *testing.T) {
+		c.On("GetSubscriptions").Return([]string{"eurusd.tickers"})
+		h.handleSubscribe(&Request{
+			client:  c,
+			Request: message.Request{Streams: []string{"eurusd.tickers"}},
+		})
+		assert.Equal(t, 5, len(sentMessages(c)))
+	})
+
+	t.Run("older values are not sent after a live message", func(t *testing.T) {
+		c := &MockedClient{}
+		c.On("SubscribePublic", "eurusd.tickers").Return()
+		c.On("Send", mock.Anything).Return()
+
+		req := &Request{client: c}
+		h.subscribePublic("eurusd.tickers", req)
+		h.routeMessage(tickerEvent("public", 4))
+		h.sendLastValues(req)
+
+		assert.Equal(t, []string{`{"eurusd.tickers":{"last":4}}`}, sentMessages(c))
+	})
+
+	t.Run("expired values are dropped", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		c := subscribe("eurusd.tickers")
+		assert.Equal(t, 1, len(sentMessages(c)))
+		assert.NotContains(t, h.shardFor("eurusd.tickers").lastValues, "eurusd.tickers")
+	})
+}
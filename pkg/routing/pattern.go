@@ -0,0 +1,338 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+
+	msg "github.com/openware/rango/pkg/message"
+	"github.com/openware/rango/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// Maximum number of patterns a client can subscribe to.
+var maxPatternsPerClient = 10
+
+// pattern is a subscription to all the topics matching a stream name with
+// wildcard segments, e.g. *.trades, eurusd.* or admin.*.sys.
+type pattern struct {
+	// Prefix of the prefixed patterns, empty for public ones
+	scope string
+
+	// Segments of the topic names, * matches any segment
+	segments []string
+
+	clients map[IClient]struct{}
+}
+
+func isPattern(s string) bool {
+	return strings.Contains(s, "*")
+}
+
+// parsePattern splits a pattern in the scope and the segments of the topics
+// it matches. Public patterns have two segments and prefixed ones three, the
+// prefix cannot be a wildcard since it is checked against the RBAC rules.
+func parsePattern(p string) (*pattern, error) {
+	if msg.StreamBase(p) != p {
+		return nil, fmt.Errorf("stream modifiers are not supported on patterns: %s", p)
+	}
+
+	segments := strings.Split(p, ".")
+	scope := ""
+
+	switch len(segments) {
+	case 2:
+	case 3:
+		scope, segments = segments[0], segments[1:]
+		if scope == "*" {
+			return nil, fmt.Errorf("pattern %s cannot match any prefix", p)
+		}
+	default:
+		return nil, fmt.Errorf("invalid pattern %s", p)
+	}
+
+	for _, s := range segments {
+		if s == "" || (s != "*" && strings.Contains(s, "*")) {
+			return nil, fmt.Errorf("invalid pattern %s", p)
+		}
+	}
+
+	return &pattern{
+		scope:    scope,
+		segments: segments,
+		clients:  make(map[IClient]struct{}),
+	}, nil
+}
+
+// match reports whether the topic of the scope matches the pattern, scope
+// is empty for public topics.
+func (p *pattern) match(scope, topic string) bool {
+	if scope != p.scope {
+		return false
+	}
+
+	segments := strings.Split(topic, ".")
+	if len(segments) != len(p.segments) {
+		return false
+	}
+
+	for i, s := range p.segments {
+		if s != "*" && s != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// scopedTopic identifies a public topic, with an empty scope, or a prefixed
+// one.
+type scopedTopic struct {
+	scope string
+	name  string
+}
+
+// subscribers are the subscribers of a routed topic: the clients of the
+// topic, which may be nil, and the clients of the patterns matching it.
+type subscribers struct {
+	topic    *Topic
+	patterns []*pattern
+
+	// Scope of the topic, empty for public ones
+	scope string
+}
+
+// subscribersOf returns the subscribers of a topic. The patterns matching a
+// topic are looked up the first time it is routed, then kept up to date when
+// patterns are added or removed.
+func (s *shard) subscribersOf(scope string, topic *Topic, name string) subscribers {
+	sub := subscribers{topic: topic, scope: scope}
+	if len(s.patterns) == 0 {
+		return sub
+	}
+
+	key := scopedTopic{scope, name}
+	matched, ok := s.matches[key]
+	if !ok {
+		for _, p := range s.patterns {
+			if p.match(scope, name) {
+				matched = append(matched, p)
+			}
+		}
+		s.matches[key] = matched
+	}
+	sub.patterns = matched
+	return sub
+}
+
+// addPattern registers a new pattern and adds it to the matches of the
+// topics routed so far.
+func (s *shard) addPattern(name string, p *pattern) {
+	s.patterns[name] = p
+	for k, matched := range s.matches {
+		if p.match(k.scope, k.name) {
+			s.matches[k] = append(matched, p)
+		}
+	}
+}
+
+// removePattern removes a pattern from the shard and from the matches of
+// the topics, the topics matching no pattern are forgotten.
+func (s *shard) removePattern(name string) {
+	p, ok := s.patterns[name]
+	if !ok {
+		return
+	}
+	delete(s.patterns, name)
+
+	if len(s.patterns) == 0 {
+		s.matches = make(map[scopedTopic][]*pattern)
+		return
+	}
+
+	for k, matched := range s.matches {
+		for i, m := range matched {
+			if m == p {
+				matched = append(matched[:i:i], matched[i+1:]...)
+				s.matches[k] = matched
+				break
+			}
+		}
+		if len(matched) == 0 {
+			delete(s.matches, k)
+		}
+	}
+}
+
+func (sub subscribers) empty() bool {
+	return (sub.topic == nil || sub.topic.len() == 0) && len(sub.patterns) == 0
+}
+
+// each calls f once for each subscriber, the clients subscribed to the
+// topic and to several patterns are only visited once.
+func (sub subscribers) each(f func(IClient)) {
+	if sub.topic != nil {
+		for c := range sub.topic.clients {
+			f(c)
+		}
+	}
+
+	for i, p := range sub.patterns {
+		for c := range p.clients {
+			if !sub.visited(c, i) {
+				f(c)
+			}
+		}
+	}
+}
+
+// visited reports whether the client was visited before the i-th pattern.
+func (sub subscribers) visited(c IClient, i int) bool {
+	if sub.topic != nil {
+		if _, ok := sub.topic.clients[c]; ok {
+			return true
+		}
+	}
+	for _, p := range sub.patterns[:i] {
+		if _, ok := p.clients[c]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcast sends the event to the subscribers.
+func (sub subscribers) broadcast(message *Event) {
+	body, err := packEvent(message.Topic, message.Body)
+	if err != nil {
+		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
+		return
+	}
+
+	sub.broadcastRaw(message.Topic, string(body))
+}
+
+// broadcastRaw sends a message of the topic to the subscribers like
+// Topic.broadcastRaw, the websocket frame is prepared once for all of them.
+func (sub subscribers) broadcastRaw(topic, msgBody string) {
+	m := outbound{text: msgBody, topic: topic, lane: laneOf(sub.scope)}
+	sub.each(func(c IClient) {
+		send(c, &m)
+	})
+}
+
+// replayPattern sends the state of the incremental topics matching the
+// pattern to a new subscriber.
+func (s *shard) replayPattern(p *pattern, c IClient) {
+	objects := s.incrementalObjects
+	if p.scope != "" {
+		objects = s.prefixedObjects[p.scope]
+	}
+
+	for t, o := range objects {
+		if p.match(p.scope, t) {
+			o.replay(c, p.scope)
+		}
+	}
+}
+
+// replayToPatterns sends the first snapshot of a new incremental topic to
+// the subscribers of the patterns matching it, they subscribed before the
+// topic existed.
+func replayToPatterns(objects incrementalObjects, sub subscribers, name string) {
+	o, ok := objects[name]
+	if !ok {
+		return
+	}
+
+	for _, p := range sub.patterns {
+		for c := range p.clients {
+			o.replay(c, p.scope)
+		}
+	}
+}
+
+func patternsCount(c IClient) int {
+	count := 0
+	for _, s := range c.GetSubscriptions() {
+		if isPattern(s) {
+			count++
+		}
+	}
+	return count
+}
+
+func (h *Hub) subscribePattern(name string, req *Request) {
+	parsed, err := parsePattern(name)
+	if err != nil {
+		req.client.Send(responseMust(err, nil))
+		return
+	}
+
+	if parsed.scope != "" && !h.premittedRBAC(parsed.scope, req.client.GetAuth()) {
+		req.client.Send(responseMust(nil, map[string]interface{}{
+			"message": "cannot subscribe to " + name,
+		}))
+		return
+	}
+
+	subscriptions := req.client.GetSubscriptions()
+	if !contains(subscriptions, name) && patternsCount(req.client) >= maxPatternsPerClient {
+		req.client.Send(responseMust(fmt.Errorf("cannot subscribe to more than %d patterns", maxPatternsPerClient), nil))
+		return
+	}
+
+	// Patterns are registered shard by shard with the snapshots of the
+	// matching topics, no increment can be sent before its snapshot.
+	subscribed := false
+	for _, s := range h.shards {
+		s.mutex.Lock()
+		p, ok := s.patterns[name]
+		if !ok {
+			p, _ = parsePattern(name)
+			s.addPattern(name, p)
+		}
+
+		if _, ok := p.clients[req.client]; !ok {
+			p.clients[req.client] = struct{}{}
+			s.replayPattern(p, req.client)
+			subscribed = true
+		}
+		s.mutex.Unlock()
+	}
+
+	if subscribed {
+		metrics.RecordHubSubscription("pattern", name)
+		req.client.SubscribePublic(name)
+	}
+}
+
+func (h *Hub) unsubscribePattern(name string, req *Request) {
+	unsubscribed := false
+	for _, s := range h.shards {
+		s.mutex.Lock()
+		if s.deletePatternClient(name, req.client) {
+			unsubscribed = true
+		}
+		s.mutex.Unlock()
+	}
+
+	if unsubscribed {
+		metrics.RecordHubUnsubscription("pattern", name)
+		req.client.UnsubscribePublic(name)
+	}
+}
+
+// deletePatternClient removes the client from the pattern and the pattern
+// once it has no client left.
+func (s *shard) deletePatternClient(name string, c IClient) bool {
+	p, ok := s.patterns[name]
+	if !ok {
+		return false
+	}
+
+	_, ok = p.clients[c]
+	delete(p.clients, c)
+	if len(p.clients) == 0 {
+		s.removePattern(name)
+	}
+	return ok
+}
@@ -0,0 +1,180 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParsePattern(t *testing.T) {
+	p, err := parsePattern("*.trades")
+	assert.NoError(t, err)
+	assert.True(t, p.match("", "eurusd.trades"))
+	assert.False(t, p.match("", "eurusd.tickers"))
+	assert.False(t, p.match("admin", "eurusd.trades"))
+
+	p, err = parsePattern("eurusd.*")
+	assert.NoError(t, err)
+	assert.True(t, p.match("", "eurusd.ob-inc"))
+	assert.False(t, p.match("", "btcusd.trades"))
+
+	p, err = parsePattern("admin.*.sys")
+	assert.NoError(t, err)
+	assert.Equal(t, "admin", p.scope)
+	assert.True(t, p.match("admin", "eurusd.sys"))
+	assert.False(t, p.match("", "eurusd.sys"))
+	assert.False(t, p.match("admin", "eurusd.trades"))
+
+	for _, invalid := range []string{"*", "*.*.*.*", "*.eurusd.trades", "eur*.trades", "*.", "*.ob-inc@10"} {
+		_, err := parsePattern(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPatternSubscriptions(t *testing.T) {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+	book := func(market, typ string, seq int) *Event {
+		return &Event{
+			Scope:  "public",
+			Stream: market,
+			Type:   typ,
+			Topic:  market + ".ob-inc",
+			Body:   map[string]interface{}{"asks": [][]string{{"1.0", "1"}}, "sequence": seq},
+		}
+	}
+	h.routeMessage(book("eurusd", "ob-snap", 1))
+
+	c := &MockedClient{}
+	c.On("GetAuth").Return(Auth{})
+	c.On("GetSubscriptions").Return([]string{})
+	c.On("SubscribePublic", mock.Anything).Return()
+	c.On("UnsubscribePublic", mock.Anything).Return()
+	c.On("Send", mock.Anything).Return()
+
+	h.subscribePattern("*.ob-inc", &Request{client: c})
+	h.subscribePattern("*.trades", &Request{client: c})
+	h.subscribePublic("eurusd.trades", &Request{client: c})
+	c.AssertCalled(t, "SubscribePublic", "*.ob-inc")
+
+	// Existing and future topics match, messages are sent once per client
+	h.routeMessage(book("eurusd", "ob-inc", 2))
+	h.routeMessage(book("btcusd", "ob-snap", 7))
+	h.routeMessage(book("btcusd", "ob-inc", 8))
+	h.routeMessage(tradeEvent("public", 1))
+	h.routeMessage(tickerEvent("public", 1))
+
+	assert.Equal(t, []string{
+		`{"eurusd.ob-snap":{"asks":[["1.0","1"]],"bids":[],"sequence":1}}`,
+		`{"eurusd.ob-inc":{"asks":[["1.0","1"]],"sequence":2}}`,
+		`{"btcusd.ob-snap":{"asks":[["1.0","1"]],"bids":[],"sequence":7}}`,
+		`{"btcusd.ob-inc":{"asks":[["1.0","1"]],"sequence":8}}`,
+		`{"eurusd.trades":{"tid":1}}`,
+	}, sentMessages(c))
+
+	t.Run("unsubscribe a pattern", func(t *testing.T) {
+		h.unsubscribePattern("*.trades", &Request{client: c})
+		c.AssertCalled(t, "UnsubscribePublic", "*.trades")
+
+		for _, s := range h.shards {
+			assert.NotContains(t, s.patterns, "*.trades")
+			assert.Contains(t, s.patterns, "*.ob-inc")
+		}
+
+		h.unsubscribeAll(c)
+		for _, s := range h.shards {
+			assert.Empty(t, s.patterns)
+		}
+	})
+}
+
+func TestPatternMatches(t *testing.T) {
+	h := NewHub(nil)
+	s := h.shardFor("eurusd.trades")
+
+	c := &MockedClient{}
+	c.On("GetAuth").Return(Auth{})
+	c.On("GetSubscriptions").Return([]string{})
+	c.On("SubscribePublic", mock.Anything).Return()
+	c.On("UnsubscribePublic", mock.Anything).Return()
+	c.On("Send", mock.Anything).Return()
+
+	h.subscribePattern("*.trades", &Request{client: c})
+	h.routeMessage(tradeEvent("public", 1))
+	assert.Len(t, s.matches[scopedTopic{"", "eurusd.trades"}], 1)
+
+	// Patterns added later are added to the matches of the routed topics,
+	// the clients matching several patterns get the message once
+	h.subscribePattern("eurusd.*", &Request{client: c})
+	assert.Len(t, s.matches[scopedTopic{"", "eurusd.trades"}], 2)
+	h.routeMessage(tradeEvent("public", 2))
+
+	h.subscribePattern("btcusd.*", &Request{client: c})
+	h.unsubscribePattern("*.trades", &Request{client: c})
+	assert.Len(t, s.matches[scopedTopic{"", "eurusd.trades"}], 1)
+	h.routeMessage(tradeEvent("public", 3))
+
+	// The topics matching no pattern are forgotten
+	h.unsubscribePattern("eurusd.*", &Request{client: c})
+	_, ok := s.matches[scopedTopic{"", "eurusd.trades"}]
+	assert.False(t, ok)
+	h.routeMessage(tradeEvent("public", 4))
+
+	h.unsubscribePattern("btcusd.*", &Request{client: c})
+	assert.Empty(t, s.matches)
+
+	assert.Equal(t, []string{
+		`{"eurusd.trades":{"tid":1}}`,
+		`{"eurusd.trades":{"tid":2}}`,
+		`{"eurusd.trades":{"tid":3}}`,
+	}, sentMessages(c))
+}
+
+func TestPatternRestrictions(t *testing.T) {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+
+	t.Run("prefixed patterns respect the RBAC rules", func(t *testing.T) {
+		c := &MockedClient{}
+		c.On("GetAuth").Return(Auth{Role: "member"})
+		c.On("Send", mock.Anything).Return()
+
+		h.subscribePattern("admin.*.sys", &Request{client: c})
+		assert.Equal(t, []string{
+			`{"success":{"message":"cannot subscribe to admin.*.sys"}}`,
+		}, sentMessages(c))
+		assert.Empty(t, h.shards[0].patterns)
+	})
+
+	t.Run("prefixed messages are delivered to admins", func(t *testing.T) {
+		c := &MockedClient{}
+		c.On("GetAuth").Return(Auth{Role: "admin"})
+		c.On("GetSubscriptions").Return([]string{})
+		c.On("SubscribePublic", "admin.*.sys").Return()
+		c.On("Send", mock.Anything).Return()
+
+		h.subscribePattern("admin.*.sys", &Request{client: c})
+		h.routeMessage(&Event{Scope: "admin", Stream: "eurusd", Type: "sys", Topic: "eurusd.sys", Body: 1})
+		h.routeMessage(&Event{Scope: "public", Stream: "eurusd", Type: "sys", Topic: "eurusd.sys", Body: 2})
+		assert.Equal(t, []string{`{"eurusd.sys":1}`}, sentMessages(c))
+	})
+
+	t.Run("the number of patterns is capped", func(t *testing.T) {
+		defer func(n int) { maxPatternsPerClient = n }(maxPatternsPerClient)
+		maxPatternsPerClient = 2
+
+		c := &MockedClient{}
+		c.On("GetAuth").Return(Auth{})
+		c.On("GetSubscriptions").Return([]string{"*.trades", "eurusd.trades", "eurusd.*"})
+		c.On("Send", mock.Anything).Return()
+
+		h.handleSubscribe(&Request{
+			client:  c,
+			Request: message.Request{Streams: []string{"*.tickers"}},
+		})
+		assert.Equal(t, []string{
+			`{"error":"cannot subscribe to more than 2 patterns"}`,
+			`{"success":{"message":"subscribed","streams":["*.trades","eurusd.trades","eurusd.*"]}}`,
+		}, sentMessages(c))
+	})
+}
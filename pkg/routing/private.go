@@ -0,0 +1,53 @@
+package routing
+
+import (
+	"time"
+)
+
+// privateObjects are the incremental objects of the private topics of a user.
+type privateObjects struct {
+	objects incrementalObjects
+
+	// Time since which the user has no private subscription, zero while
+	// subscribed or until the next expiry pass
+	idleSince time.Time
+}
+
+// userObjects returns the incremental objects of the user.
+func (s *shard) userObjects(uid string) incrementalObjects {
+	p, ok := s.privateObjects[uid]
+	if !ok {
+		p = &privateObjects{objects: make(incrementalObjects, 1)}
+		s.privateObjects[uid] = p
+	}
+	return p.objects
+}
+
+// ExpirePrivateObjects frees the incremental objects of the users without
+// private subscriptions for ttl. It checks them every half ttl and never
+// returns.
+func (h *Hub) ExpirePrivateObjects(ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		h.expirePrivateObjects(now, ttl)
+	}
+}
+
+func (h *Hub) expirePrivateObjects(now time.Time, ttl time.Duration) {
+	for _, s := range h.shards {
+		s.mutex.Lock()
+		for uid, p := range s.privateObjects {
+			switch {
+			case len(s.privateTopics[uid]) > 0:
+				p.idleSince = time.Time{}
+			case p.idleSince.IsZero():
+				p.idleSince = now
+			case now.Sub(p.idleSince) >= ttl:
+				delete(s.privateObjects, uid)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
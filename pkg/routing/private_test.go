@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func balancesEvent(uid, typ string, body interface{}) *Event {
+	return &Event{
+		Scope:  "private",
+		Stream: uid,
+		Type:   typ,
+		Topic:  "balances-inc",
+		Body:   body,
+	}
+}
+
+func TestPrivateIncrementalObjects(t *testing.T) {
+	h := NewHub(nil)
+	h.routeMessage(balancesEvent("UID123", "balances-snap", map[string]interface{}{"eur": "100"}))
+	h.routeMessage(balancesEvent("UID123", "balances-inc", map[string]interface{}{"eur": "90"}))
+	h.routeMessage(balancesEvent("UID456", "balances-snap", map[string]interface{}{"usd": "5"}))
+
+	c := &MockedClient{}
+	c.On("GetAuth").Return(Auth{UID: "UID123"})
+	c.On("SubscribePrivate", "balances-inc").Return()
+	c.On("Send", mock.Anything).Return()
+	h.subscribePrivate("balances-inc", &Request{client: c})
+
+	h.routeMessage(balancesEvent("UID123", "balances-inc", map[string]interface{}{"eur": "80"}))
+	h.routeMessage(balancesEvent("UID456", "balances-inc", map[string]interface{}{"usd": "4"}))
+
+	assert.Equal(t, []string{
+		`{"balances-snap":{"eur":"100"}}`,
+		`{"balances-inc":{"eur":"90"}}`,
+		`{"balances-inc":{"eur":"80"}}`,
+	}, sentMessages(c))
+
+	t.Run("objects of users without subscription expire", func(t *testing.T) {
+		s := h.shardFor("UID456")
+		now := time.Now()
+
+		h.expirePrivateObjects(now, time.Minute)
+		h.expirePrivateObjects(now.Add(30*time.Second), time.Minute)
+		assert.Contains(t, s.privateObjects, "UID456")
+
+		h.expirePrivateObjects(now.Add(time.Minute), time.Minute)
+		assert.NotContains(t, s.privateObjects, "UID456")
+		assert.Contains(t, h.shardFor("UID123").privateObjects, "UID123")
+	})
+
+	t.Run("idle time restarts with a new subscription", func(t *testing.T) {
+		c.On("GetSubscriptions").Return([]string{})
+		s := h.shardFor("UID123")
+		now := time.Now()
+
+		h.unsubscribeAll(c)
+		h.expirePrivateObjects(now, time.Minute)
+		h.subscribePrivate("balances-inc", &Request{client: c})
+		h.expirePrivateObjects(now.Add(time.Minute), time.Minute)
+		assert.Contains(t, s.privateObjects, "UID123")
+		assert.True(t, s.privateObjects["UID123"].idleSince.IsZero())
+	})
+}
+
+func TestPrivateIncrementsWithSessions(t *testing.T) {
+	h := NewHub(nil)
+	h.Sessions = NewSessions(time.Minute, 10)
+	h.routeMessage(balancesEvent("UID123", "balances-snap", map[string]interface{}{"eur": "100"}))
+
+	c := sessionClient()
+	c.On("SubscribePrivate", "balances-inc").Return()
+	connect(h, c, "", "", "balances-inc")
+	h.routeMessage(balancesEvent("UID123", "balances-inc", map[string]interface{}{"eur": "90"}))
+
+	sent := sentMessages(c)
+	assert.Equal(t, []string{
+		`{"balances-snap":{"eur":"100"}}`,
+		`{"success":{"message":"subscribed","streams":["order"]}}`,
+		`{"seq":1,"balances-inc":{"eur":"90"}}`,
+	}, sent[1:])
+}
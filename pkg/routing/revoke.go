@@ -0,0 +1,233 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	msg "github.com/openware/rango/pkg/message"
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+)
+
+// Close code of the connections whose session was revoked
+const closeSessionRevoked = 4002
+
+// Number of control messages buffered before ReceiveMsg blocks, they are
+// handled by the hub goroutine between the requests of the clients.
+var controlsBuffer = 256
+
+// connections indexes the authenticated connections by UID.
+type connections struct {
+	uids  map[string]map[IClient]struct{}
+	mutex sync.Mutex
+}
+
+func newConnections() *connections {
+	return &connections{
+		uids: make(map[string]map[IClient]struct{}),
+	}
+}
+
+func (r *connections) add(c IClient, uid string) {
+	if uid == "" {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	clients, ok := r.uids[uid]
+	if !ok {
+		clients = make(map[IClient]struct{}, 1)
+		r.uids[uid] = clients
+	}
+	clients[c] = struct{}{}
+}
+
+func (r *connections) remove(c IClient, uid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	clients := r.uids[uid]
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(r.uids, uid)
+	}
+}
+
+func (r *connections) list(uid string) []IClient {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	res := make([]IClient, 0, len(r.uids[uid]))
+	for c := range r.uids[uid] {
+		res = append(res, c)
+	}
+	return res
+}
+
+// control is a message of the upstream revoking the sessions of a user or
+// changing its role.
+type control struct {
+	// Action of the control message: revoke or role
+	Action string `json:"-"`
+
+	// User whose connections are revoked or whose role changed
+	UID string `json:"uid"`
+
+	// Session revoked instead of all the connections of the user
+	Session string `json:"session"`
+
+	// New role of the user
+	Role string `json:"role"`
+
+	// Reason of the revocation, forwarded to the client
+	Reason string `json:"reason"`
+}
+
+const (
+	controlRevoke = "revoke"
+	controlRole   = "role"
+)
+
+// parseControl returns the control message of an AMQP delivery, nil if its
+// routing key is not a control key.
+func (h *Hub) parseControl(delivery amqp.Delivery) (*control, error) {
+	ctl := &control{}
+	switch {
+	case h.RevokeRoutingKey != "" && delivery.RoutingKey == h.RevokeRoutingKey:
+		ctl.Action = controlRevoke
+	case h.RoleRoutingKey != "" && delivery.RoutingKey == h.RoleRoutingKey:
+		ctl.Action = controlRole
+	default:
+		return nil, nil
+	}
+
+	if err := json.Unmarshal(delivery.Body, ctl); err != nil {
+		return nil, fmt.Errorf("Control message parse error: %s, msg: %s", err.Error(), delivery.Body)
+	}
+
+	switch {
+	case ctl.Action == controlRevoke && ctl.UID == "" && ctl.Session == "":
+		return nil, errors.New("Revocation without uid nor session")
+	case ctl.Action == controlRole && (ctl.UID == "" || ctl.Role == ""):
+		return nil, errors.New("Role change without uid or role")
+	}
+	return ctl, nil
+}
+
+// handleControl applies a control message, it is called by the hub goroutine
+// so that it is not interleaved with the requests of the clients.
+func (h *Hub) handleControl(ctl *control) {
+	switch ctl.Action {
+	case controlRevoke:
+		if ctl.Session != "" {
+			h.revokeSession(ctl.Session, ctl.Reason)
+		} else {
+			h.revokeUser(ctl.UID, ctl.Reason)
+		}
+	case controlRole:
+		h.changeRole(ctl.UID, ctl.Role)
+	}
+}
+
+// revokeUser closes all the connections of the user and drops its sessions,
+// they cannot be resumed.
+func (h *Hub) revokeUser(uid, reason string) {
+	clients := h.users.list(uid)
+	log.Info().Msgf("Revoking %d connections of %s", len(clients), uid)
+
+	if h.Sessions != nil {
+		sh := h.shardFor(uid)
+		sh.mutex.Lock()
+		h.Sessions.revokeUser(uid)
+		sh.mutex.Unlock()
+	}
+
+	for _, c := range clients {
+		h.revoke(c, reason)
+	}
+}
+
+// revokeSession closes the connection of the session and drops it.
+func (h *Hub) revokeSession(id, reason string) {
+	if h.Sessions == nil {
+		log.Warn().Msgf("Session %s not revoked: sessions are disabled", id)
+		return
+	}
+
+	uid := h.Sessions.uidOf(id)
+	if uid == "" {
+		return
+	}
+
+	sh := h.shardFor(uid)
+	sh.mutex.Lock()
+	clients := h.Sessions.revoke(id)
+	sh.mutex.Unlock()
+
+	log.Info().Msgf("Revoking session %s of %s", id, uid)
+	for _, c := range clients {
+		h.revoke(c, reason)
+	}
+}
+
+// revoke notifies the client its session is revoked and closes its
+// connection.
+func (h *Hub) revoke(c IClient, reason string) {
+	h.users.remove(c, c.GetAuth().UID)
+
+	notice := map[string]interface{}{}
+	if reason != "" {
+		notice["reason"] = reason
+	}
+	text := string(eventMust("session_revoked", notice))
+
+	if d, ok := c.(disconnecter); ok {
+		d.disconnect(closeSessionRevoked, "session revoked", text)
+	} else {
+		c.Send(text)
+		c.Close()
+	}
+}
+
+// changeRole updates the role of the connections of the user and
+// unsubscribes the prefixed streams the new role is not allowed to.
+func (h *Hub) changeRole(uid, role string) {
+	for _, c := range h.users.list(uid) {
+		auth := c.GetAuth()
+		auth.Role = role
+		h.sendRoleChanged(c, role, h.recheckRole(c, auth))
+	}
+}
+
+// recheckRole sets the identity of a connection and unsubscribes the
+// prefixed streams its role is not allowed to by the RBAC rules, they are
+// returned.
+func (h *Hub) recheckRole(c IClient, auth Auth) []string {
+	c.SetAuth(auth)
+
+	req := &Request{client: c}
+	streams := []string{}
+	for _, t := range c.GetSubscriptions() {
+		n, err := msg.ParseStreamName(t)
+		if err != nil || n.Scope == msg.ScopePublic || n.Scope == msg.ScopePrivate {
+			continue
+		}
+		if h.premittedRBAC(n.Scope, auth) {
+			continue
+		}
+		h.unsubscribeStream(t, n, req)
+		streams = append(streams, t)
+	}
+	return streams
+}
+
+func (h *Hub) sendRoleChanged(c IClient, role string, streams []string) {
+	c.Send(string(eventMust("role_changed", map[string]interface{}{
+		"role":    role,
+		"streams": streams,
+	})))
+}
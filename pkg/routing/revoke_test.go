@@ -0,0 +1,162 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func controlHub() *Hub {
+	h := NewHub(map[string][]string{"admin": {"admin"}})
+	h.RevokeRoutingKey = "system.session.revoke"
+	h.RoleRoutingKey = "system.session.role"
+	return h
+}
+
+func connectedClient(h *Hub, uid, role string) *Client {
+	c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil), Auth: Auth{UID: uid, Role: role}, session: true}
+	h.openSession(c, "", "")
+	h.users.add(c, uid)
+	queuedTexts(c.send)
+	return c
+}
+
+func TestParseControl(t *testing.T) {
+	h := controlHub()
+
+	ctl, err := h.parseControl(amqp.Delivery{RoutingKey: "public.eurusd.trades", Body: []byte(`{}`)})
+	assert.NoError(t, err)
+	assert.Nil(t, ctl)
+
+	ctl, err = h.parseControl(amqp.Delivery{RoutingKey: "system.session.revoke", Body: []byte(`{"uid":"UID123","reason":"logout"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, &control{Action: controlRevoke, UID: "UID123", Reason: "logout"}, ctl)
+
+	ctl, err = h.parseControl(amqp.Delivery{RoutingKey: "system.session.role", Body: []byte(`{"uid":"UID123","role":"member"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, &control{Action: controlRole, UID: "UID123", Role: "member"}, ctl)
+
+	for _, body := range []string{`{}`, `{"uid":"UID123"`} {
+		_, err = h.parseControl(amqp.Delivery{RoutingKey: "system.session.revoke", Body: []byte(body)})
+		assert.Error(t, err, body)
+	}
+	_, err = h.parseControl(amqp.Delivery{RoutingKey: "system.session.role", Body: []byte(`{"uid":"UID123"}`)})
+	assert.EqualError(t, err, "Role change without uid or role")
+
+	// Control messages are ignored when their routing key is not configured
+	h.RevokeRoutingKey = ""
+	ctl, err = h.parseControl(amqp.Delivery{RoutingKey: "system.session.revoke", Body: []byte(`{"uid":"UID123"}`)})
+	assert.NoError(t, err)
+	assert.Nil(t, ctl)
+}
+
+func TestReceiveControlBuffered(t *testing.T) {
+	h := controlHub()
+
+	// The AMQP consumer is not blocked while the hub handles requests
+	received := make(chan struct{})
+	go func() {
+		h.ReceiveMsg(amqp.Delivery{RoutingKey: "system.session.role", Body: []byte(`{"uid":"UID123","role":"admin"}`)})
+		close(received)
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("control message not buffered")
+	}
+	assert.Len(t, h.controls, 1)
+}
+
+func TestRevokeUser(t *testing.T) {
+	h := controlHub()
+	h.Sessions = NewSessions(time.Minute, 10)
+	go h.ListenWebsocketEvents()
+
+	c1 := connectedClient(h, "UID123", "member")
+	c2 := connectedClient(h, "UID123", "member")
+	other := connectedClient(h, "UID456", "member")
+	c1.sendEvent(outbound{text: `{"eurusd.trades":{}}`, topic: "eurusd.trades", lane: lanePublic})
+
+	h.ReceiveMsg(amqp.Delivery{RoutingKey: "system.session.revoke", Body: []byte(`{"uid":"UID123","reason":"logout"}`)})
+	require.Eventually(t, func() bool {
+		c2.send.mutex.Lock()
+		defer c2.send.mutex.Unlock()
+		return c2.send.closed
+	}, time.Second, 10*time.Millisecond)
+
+	for _, c := range []*Client{c1, c2} {
+		// The queued messages are dropped for the notice
+		assert.Equal(t, []string{`{"session_revoked":{"reason":"logout"}}`}, queuedTexts(c.send))
+		closed, code, reason := c.send.done()
+		assert.True(t, closed)
+		assert.Equal(t, closeSessionRevoked, code)
+		assert.Equal(t, "session revoked", reason)
+	}
+
+	closed, _, _ := other.send.done()
+	assert.False(t, closed)
+	assert.Empty(t, h.users.list("UID123"))
+	assert.Len(t, h.users.list("UID456"), 1)
+
+	// The sessions of the user cannot be resumed
+	h.Sessions.mutex.Lock()
+	assert.NotContains(t, h.Sessions.uids, "UID123")
+	assert.Contains(t, h.Sessions.uids, "UID456")
+	h.Sessions.mutex.Unlock()
+}
+
+func TestRevokeSession(t *testing.T) {
+	h := controlHub()
+	h.Sessions = NewSessions(time.Minute, 10)
+
+	c1 := connectedClient(h, "UID123", "member")
+	c2 := connectedClient(h, "UID123", "member")
+	id := h.Sessions.clients[c1].id
+
+	h.handleControl(&control{Action: controlRevoke, Session: id})
+	assert.Equal(t, []string{`{"session_revoked":{}}`}, queuedTexts(c1.send))
+	closed, code, _ := c1.send.done()
+	assert.True(t, closed)
+	assert.Equal(t, closeSessionRevoked, code)
+
+	closed, _, _ = c2.send.done()
+	assert.False(t, closed)
+	assert.Equal(t, []IClient{c2}, h.users.list("UID123"))
+	assert.Equal(t, "", h.Sessions.uidOf(id))
+
+	// Unknown sessions are ignored
+	h.handleControl(&control{Action: controlRevoke, Session: id})
+	closed, _, _ = c2.send.done()
+	assert.False(t, closed)
+}
+
+func TestChangeRole(t *testing.T) {
+	h := controlHub()
+	c := connectedClient(h, "UID123", "admin")
+
+	h.handleRequest(&Request{client: c, Request: message.Request{
+		Method:  "subscribe",
+		Streams: []string{"eurusd.trades", "order", "admin.eurusd.sys", "admin.*.sys"},
+	}})
+	queuedTexts(c.send)
+
+	h.handleControl(&control{Action: controlRole, UID: "UID123", Role: "member"})
+	assert.Equal(t, "member", c.GetAuth().Role)
+	assert.Equal(t, []string{`{"role_changed":{"role":"member","streams":["admin.eurusd.sys","admin.*.sys"]}}`}, queuedTexts(c.send))
+	assert.ElementsMatch(t, []string{"eurusd.trades", "order"}, c.GetSubscriptions())
+
+	h.routeMessage(&Event{Scope: "admin", Stream: "eurusd", Type: "sys", Topic: "eurusd.sys", Body: 1})
+	assert.Empty(t, queuedTexts(c.send))
+
+	// The prefixed streams allowed to the new role are kept
+	h.handleControl(&control{Action: controlRole, UID: "UID123", Role: "admin"})
+	h.handleRequest(&Request{client: c, Request: message.Request{Method: "subscribe", Streams: []string{"admin.eurusd.sys"}}})
+	queuedTexts(c.send)
+	h.handleControl(&control{Action: controlRole, UID: "UID123", Role: "admin"})
+	assert.Equal(t, []string{`{"role_changed":{"role":"admin","streams":[]}}`}, queuedTexts(c.send))
+}
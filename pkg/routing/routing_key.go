@@ -0,0 +1,192 @@
+package routing
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RoutingRule maps the AMQP routing keys matching a regular expression to
+// events. Scope, Stream, Type and Topic are templates expanded with the
+// captures of the expression, e.g. kline-${period}.
+type RoutingRule struct {
+	// Regular expression matched against the whole routing key
+	Pattern string `yaml:"pattern"`
+
+	// Templates of the event fields, the captures of the same name by
+	// default
+	Scope  string `yaml:"scope"`
+	Stream string `yaml:"stream"`
+	Type   string `yaml:"type"`
+
+	// Template of the topic name, derived from the other fields when empty
+	Topic string `yaml:"topic"`
+
+	re *regexp.Regexp
+}
+
+// RoutingRules maps AMQP routing keys to events with the first matching rule,
+// the keys matching no rule fall back to the scope.stream.type and scope.type
+// formats.
+type RoutingRules struct {
+	rules []*RoutingRule
+}
+
+type routingConfig struct {
+	Rules []RoutingRule `yaml:"rules"`
+}
+
+func NewRoutingRules(rules []RoutingRule) (*RoutingRules, error) {
+	r := &RoutingRules{}
+
+	for i := range rules {
+		rule := rules[i]
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("routing rule %d: missing pattern", i)
+		}
+
+		re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("routing rule %d: %w", i, err)
+		}
+		rule.re = re
+
+		rule.Scope = defaultTemplate(re, rule.Scope, "scope")
+		rule.Stream = defaultTemplate(re, rule.Stream, "stream")
+		rule.Type = defaultTemplate(re, rule.Type, "type")
+		if rule.Scope == "" || rule.Type == "" {
+			return nil, fmt.Errorf("routing rule %d: scope and type must be set or captured", i)
+		}
+
+		for _, tpl := range []string{rule.Scope, rule.Stream, rule.Type, rule.Topic} {
+			if err := checkTemplate(re, tpl); err != nil {
+				return nil, fmt.Errorf("routing rule %d: %w", i, err)
+			}
+		}
+
+		r.rules = append(r.rules, &rule)
+	}
+
+	return r, nil
+}
+
+// LoadRoutingRules reads the rules of a YAML file:
+//
+//	rules:
+//	  - pattern: 'public\.(?P<stream>[^.]+)\.kline\.(?P<period>[^.]+)'
+//	    scope: public
+//	    type: kline-${period}
+func LoadRoutingRules(path string) (*RoutingRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config routingConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return NewRoutingRules(config.Rules)
+}
+
+// defaultTemplate returns the template of a field, the capture of the same
+// name if not set.
+func defaultTemplate(re *regexp.Regexp, tpl, name string) string {
+	if tpl == "" && re.SubexpIndex(name) >= 0 {
+		return "${" + name + "}"
+	}
+	return tpl
+}
+
+var templateVariable = regexp.MustCompile(`\$\{?(\w+)\}?`)
+
+// checkTemplate rejects the templates using a capture missing from the
+// pattern, which would always expand to an empty string.
+func checkTemplate(re *regexp.Regexp, tpl string) error {
+	for _, m := range templateVariable.FindAllStringSubmatch(tpl, -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil && n <= re.NumSubexp() {
+			continue
+		}
+		if re.SubexpIndex(m[1]) < 0 {
+			return fmt.Errorf("unknown capture %q in %q", m[1], tpl)
+		}
+	}
+	return nil
+}
+
+// Map returns the event of a routing key, without body.
+func (r *RoutingRules) Map(key string) (*Event, error) {
+	for _, rule := range r.rules {
+		if m := rule.re.FindStringSubmatchIndex(key); m != nil {
+			return rule.event(key, m)
+		}
+	}
+
+	return parseRoutingKey(key)
+}
+
+func (rule *RoutingRule) event(key string, m []int) (*Event, error) {
+	expand := func(tpl string) string {
+		return string(rule.re.ExpandString(nil, tpl, key, m))
+	}
+
+	msg := &Event{
+		Scope:  expand(rule.Scope),
+		Stream: expand(rule.Stream),
+		Type:   expand(rule.Type),
+	}
+
+	switch {
+	case msg.Scope == "" || msg.Type == "":
+		return nil, fmt.Errorf("Bad routing key: %s, empty scope or type", key)
+	case msg.Scope == "private" && msg.Stream == "":
+		return nil, fmt.Errorf("Bad routing key: %s, private event without UID", key)
+	}
+
+	if rule.Topic != "" {
+		// Snapshots are routed to the topic of their increments like
+		// with getTopic
+		msg.Topic = expand(rule.Topic)
+		if isSnapshotObject(msg.Topic) {
+			msg.Topic = strings.TrimSuffix(msg.Topic, "-snap") + "-inc"
+		}
+	} else if msg.Stream == "" {
+		msg.Topic = getTopic(msg.Scope, msg.Scope, msg.Type)
+	} else {
+		msg.Topic = getTopic(msg.Scope, msg.Stream, msg.Type)
+	}
+
+	return msg, nil
+}
+
+// parseRoutingKey returns the event of a scope.stream.type or scope.type
+// routing key, without body.
+func parseRoutingKey(key string) (*Event, error) {
+	s := strings.Split(key, ".")
+
+	switch len(s) {
+	case 2:
+		return &Event{
+			Scope:  s[0],
+			Stream: "",
+			Type:   s[1],
+			Topic:  getTopic(s[0], s[0], s[1]),
+		}, nil
+
+	case 3:
+		return &Event{
+			Scope:  s[0],
+			Stream: s[1],
+			Type:   s[2],
+			Topic:  getTopic(s[0], s[1], s[2]),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("Bad routing key: %s", key)
+	}
+}
@@ -0,0 +1,116 @@
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoutingKey(t *testing.T) {
+	msg, err := parseRoutingKey("public.eurusd.ob-snap")
+	require.NoError(t, err)
+	assert.Equal(t, &Event{Scope: "public", Stream: "eurusd", Type: "ob-snap", Topic: "eurusd.ob-inc"}, msg)
+
+	msg, err = parseRoutingKey("global.tickers")
+	require.NoError(t, err)
+	assert.Equal(t, &Event{Scope: "global", Type: "tickers", Topic: "global.tickers"}, msg)
+
+	_, err = parseRoutingKey("public.eurusd.kline.1m")
+	assert.EqualError(t, err, "Bad routing key: public.eurusd.kline.1m")
+}
+
+func TestRoutingRules(t *testing.T) {
+	rules, err := NewRoutingRules([]RoutingRule{
+		{
+			Pattern: `public\.(?P<stream>[^.]+)\.kline\.(?P<period>[^.]+)`,
+			Scope:   "public",
+			Type:    "kline-${period}",
+		},
+		{
+			Pattern: `(?P<scope>private)\.(?P<stream>[^.]+)\.(?P<type>order)\.[^.]+`,
+		},
+		{
+			Pattern: `market\.(?P<base>[a-z]+)_(?P<quote>[a-z]+)\.(?P<type>[a-z-]+)`,
+			Scope:   "public",
+			Stream:  "${base}${quote}",
+			Topic:   "${base}${quote}.${type}",
+		},
+		{
+			Pattern: `broken\.(?P<type>.*)`,
+			Scope:   "public",
+		},
+	})
+	require.NoError(t, err)
+
+	for key, expected := range map[string]*Event{
+		"public.eurusd.kline.1m":    {Scope: "public", Stream: "eurusd", Type: "kline-1m", Topic: "eurusd.kline-1m"},
+		"private.UID123.order.done": {Scope: "private", Stream: "UID123", Type: "order", Topic: "order"},
+		"market.eur_usd.trades":     {Scope: "public", Stream: "eurusd", Type: "trades", Topic: "eurusd.trades"},
+		"market.eur_usd.ob-snap":    {Scope: "public", Stream: "eurusd", Type: "ob-snap", Topic: "eurusd.ob-inc"},
+		"market.eur_usd.ob-inc":     {Scope: "public", Stream: "eurusd", Type: "ob-inc", Topic: "eurusd.ob-inc"},
+		"public.eurusd.trades":      {Scope: "public", Stream: "eurusd", Type: "trades", Topic: "eurusd.trades"},
+	} {
+		msg, err := rules.Map(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, expected, msg, key)
+	}
+
+	// Rules match the whole key, the others fall back to the default format
+	_, err = rules.Map("xpublic.eurusd.kline.1m")
+	assert.EqualError(t, err, "Bad routing key: xpublic.eurusd.kline.1m")
+
+	_, err = rules.Map("broken.")
+	assert.EqualError(t, err, "Bad routing key: broken., empty scope or type")
+
+	t.Run("invalid rules", func(t *testing.T) {
+		for _, rule := range []RoutingRule{
+			{},
+			{Pattern: `public\.(`},
+			{Pattern: `public\.(?P<stream>[^.]+)`, Scope: "public"},
+			{Pattern: `public\.(?P<type>[^.]+)`, Scope: "public", Topic: "${market}.${type}"},
+		} {
+			_, err := NewRoutingRules([]RoutingRule{rule})
+			assert.Error(t, err, rule.Pattern)
+		}
+	})
+}
+
+func TestLoadRoutingRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+rules:
+  - pattern: 'public\.(?P<stream>[^.]+)\.kline\.(?P<period>[^.]+)'
+    scope: public
+    type: kline-${period}
+`), 0600))
+
+	rules, err := LoadRoutingRules(path)
+	require.NoError(t, err)
+
+	h := NewHub(nil)
+	h.RoutingRules = rules
+	c := &MockedClient{}
+	received := make(chan struct{}, 1)
+	c.On("SubscribePublic", "eurusd.kline-1m").Return()
+	c.On("Send", `{"eurusd.kline-1m":[1,2]}`).Run(func(mock.Arguments) {
+		received <- struct{}{}
+	}).Return().Once()
+	h.subscribePublic("eurusd.kline-1m", &Request{client: c})
+
+	h.ReceiveMsg(amqp.Delivery{RoutingKey: "public.eurusd.kline.1m", Body: []byte("[1,2]")})
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message not routed")
+	}
+	c.AssertExpectations(t)
+
+	_, err = LoadRoutingRules(filepath.Join(t.TempDir(), "missing.yml"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,121 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/openware/rango/pkg/metrics"
+)
+
+// Maximum number of increments held while a topic waits for a fresh snapshot.
+var maxHeldIncrements = 1000
+
+var (
+	errSequenceGap        = errors.New("sequence gap")
+	errSequenceDuplicate  = errors.New("duplicate sequence")
+	errSequenceOutOfOrder = errors.New("out of order sequence")
+	errTopicStale         = errors.New("topic is stale, waiting for a snapshot")
+	errNoSnapshot         = errors.New("No snapshot received before the increment")
+	errBookFailed         = errors.New("failed to apply the increment to the order book")
+)
+
+// eventSequence returns the sequence field of the event body if any.
+func eventSequence(body interface{}) (int64, bool) {
+	if raw, ok := body.(json.RawMessage); ok {
+		var v struct {
+			Sequence *json.Number `json:"sequence"`
+		}
+		if json.Unmarshal(raw, &v) != nil || v.Sequence == nil {
+			return 0, false
+		}
+		n, err := v.Sequence.Int64()
+		return n, err == nil
+	}
+
+	m, ok := body.(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+
+	switch seq := m["sequence"].(type) {
+	case float64:
+		return int64(seq), true
+	case int:
+		return int64(seq), true
+	case int64:
+		return seq, true
+	case json.Number:
+		n, err := seq.Int64()
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// sequence returns the sequence of the event. The update of the order book
+// events is decoded once for the sequence and the book, a zero sequence is
+// then taken as missing.
+func (msg *Event) sequence() (int64, bool) {
+	if !isOrderBookObject(msg.Type) {
+		return eventSequence(msg.Body)
+	}
+
+	u, err := msg.orderBookUpdate()
+	if err != nil {
+		return eventSequence(msg.Body)
+	}
+	return u.Sequence, u.Sequence != 0
+}
+
+// checkSequence verifies that the increment follows the last sequence of the
+// object. On a gap the object is marked stale and the following increments
+// are held until the next snapshot.
+func (o *IncrementalObject) checkSequence(msg *Event) error {
+	if o.Stale {
+		o.hold(msg)
+		metrics.RecordHeldIncrement(msg.Topic)
+		return errTopicStale
+	}
+
+	seq, ok := msg.sequence()
+	if !ok || o.Sequence == 0 {
+		return nil
+	}
+
+	switch {
+	case seq == o.Sequence:
+		metrics.RecordSequenceDuplicate(msg.Topic)
+		return fmt.Errorf("%w %d", errSequenceDuplicate, seq)
+
+	case seq < o.Sequence:
+		metrics.RecordSequenceOutOfOrder(msg.Topic)
+		return fmt.Errorf("%w %d, last sequence is %d", errSequenceOutOfOrder, seq, o.Sequence)
+
+	case seq > o.Sequence+1:
+		metrics.RecordSequenceGap(msg.Topic)
+		expected := o.Sequence + 1
+		o.Stale = true
+		o.hold(msg)
+		return fmt.Errorf("%w: expected %d, got %d", errSequenceGap, expected, seq)
+	}
+
+	o.Sequence = seq
+	return nil
+}
+
+func (o *IncrementalObject) hold(msg *Event) {
+	if len(o.held) == maxHeldIncrements {
+		o.held = o.held[1:]
+	}
+	o.held = append(o.held, msg)
+}
+
+// resyncMessage notifies the subscribers that the stream has lost increments
+// and a new snapshot will follow.
+func resyncMessage(o *IncrementalObject, topic string) string {
+	return string(eventMust("resync", map[string]interface{}{
+		"stream":   topic,
+		"sequence": o.Sequence,
+	}))
+}
@@ -0,0 +1,460 @@
+package routing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	msg "github.com/openware/rango/pkg/message"
+	"github.com/openware/rango/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+var errResumeFailed = errors.New("resume failed")
+
+// Sessions keeps the private messages sent to the authenticated connections.
+// Each message of a session carries a sequence number, and the session
+// outlives its connection for a grace window: a client reconnecting with
+// resume=<session>&last_seq=N receives the messages it missed and its
+// subscriptions are restored.
+type Sessions struct {
+	// Time a session is kept after its connection is closed
+	grace time.Duration
+
+	// Maximum number of messages retained per session
+	size int
+
+	sessions map[string]*session
+	uids     map[string]map[*session]struct{}
+	clients  map[IClient]*session
+	mutex    sync.Mutex
+}
+
+type session struct {
+	id  string
+	uid string
+
+	// Sequence number of the last message
+	seq int64
+
+	// Last messages from the oldest to the newest
+	messages []sessionMessage
+
+	// Subscriptions of the closed connection, restored on resume
+	subscriptions []string
+
+	// Connection of the session, nil once closed
+	client IClient
+
+	// Connection resuming the session until its subscriptions are
+	// restored, messages after sent are delivered once it is attached
+	resuming IClient
+	sent     int64
+
+	expires time.Time
+}
+
+type sessionMessage struct {
+	seq     int64
+	message string
+}
+
+func NewSessions(grace time.Duration, size int) *Sessions {
+	return &Sessions{
+		grace:    grace,
+		size:     size,
+		sessions: make(map[string]*session),
+		uids:     make(map[string]map[*session]struct{}),
+		clients:  make(map[IClient]*session),
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic().Msgf("Failed to generate session id: %s", err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// create opens a new session for the connection.
+func (m *Sessions) create(c IClient) *session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := &session{
+		id:     newSessionID(),
+		uid:    c.GetAuth().UID,
+		client: c,
+	}
+
+	m.sessions[s.id] = s
+	sessions, ok := m.uids[s.uid]
+	if !ok {
+		sessions = make(map[*session]struct{}, 1)
+		m.uids[s.uid] = sessions
+	}
+	sessions[s] = struct{}{}
+	m.clients[c] = s
+
+	return s
+}
+
+// resume hands the session over to a new connection and returns the
+// messages following lastSeq, and the previous connections of the session
+// which may not be closed yet. The connection is attached once its
+// subscriptions are restored.
+func (m *Sessions) resume(c IClient, id string, lastSeq int64) (*session, []string, []IClient, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, nil, nil, errors.New("unknown or expired session")
+	}
+
+	if s.uid != c.GetAuth().UID {
+		return nil, nil, nil, errors.New("session of another user")
+	}
+
+	if lastSeq > s.seq {
+		return nil, nil, nil, errors.New("last_seq is ahead of the session")
+	}
+
+	if lastSeq < s.seq && (len(s.messages) == 0 || s.messages[0].seq > lastSeq+1) {
+		return nil, nil, nil, errors.New("missed messages are no longer retained")
+	}
+
+	previous := []IClient{}
+	if s.client != nil {
+		delete(m.clients, s.client)
+		s.subscriptions = s.client.GetSubscriptions()
+		previous = append(previous, s.client)
+		s.client = nil
+	}
+	if s.resuming != nil {
+		delete(m.clients, s.resuming)
+		previous = append(previous, s.resuming)
+	}
+
+	s.resuming = c
+	s.sent = s.seq
+	m.clients[c] = s
+
+	return s, s.since(lastSeq), previous, nil
+}
+
+// attach completes the resume of the session by the connection and returns
+// the messages received while its subscriptions were restored.
+func (m *Sessions) attach(c IClient) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.clients[c]
+	if !ok || s.resuming != c {
+		return nil
+	}
+
+	s.client = c
+	s.resuming = nil
+	return s.since(s.sent)
+}
+
+// detach keeps the session of a closed connection until the end of the
+// grace window.
+func (m *Sessions) detach(c IClient) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.clients[c]
+	if !ok {
+		return
+	}
+	delete(m.clients, c)
+
+	switch c {
+	case s.client:
+		s.subscriptions = c.GetSubscriptions()
+		s.client = nil
+	case s.resuming:
+		s.resuming = nil
+	default:
+		return
+	}
+
+	s.expires = time.Now().Add(m.grace)
+	time.AfterFunc(m.grace, func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+
+		if s.client == nil && s.resuming == nil && !time.Now().Before(s.expires) {
+			m.remove(s)
+		}
+	})
+}
+
+// uidOf returns the user of a session, empty if unknown.
+func (m *Sessions) uidOf(id string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if s, ok := m.sessions[id]; ok {
+		return s.uid
+	}
+	return ""
+}
+
+// revoke drops a session and returns its connections.
+func (m *Sessions) revoke(id string) []IClient {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil
+	}
+	return m.drop(s)
+}
+
+// revokeUser drops all the sessions of the user.
+func (m *Sessions) revokeUser(uid string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for s := range m.uids[uid] {
+		m.drop(s)
+	}
+}
+
+// drop removes a session and detaches its connections, which are returned.
+func (m *Sessions) drop(s *session) []IClient {
+	clients := []IClient{}
+	for _, c := range []IClient{s.client, s.resuming} {
+		if c != nil {
+			delete(m.clients, c)
+			clients = append(clients, c)
+		}
+	}
+	s.client = nil
+	s.resuming = nil
+	m.remove(s)
+	return clients
+}
+
+func (m *Sessions) remove(s *session) {
+	delete(m.sessions, s.id)
+
+	sessions := m.uids[s.uid]
+	delete(sessions, s)
+	if len(sessions) == 0 {
+		delete(m.uids, s.uid)
+	}
+}
+
+// broadcast sends a private message to the subscribers of the topic, which
+// may be nil if no connection is subscribed. The message is numbered and
+// retained for each session subscribed to it, connected or not.
+func (m *Sessions) broadcast(uid string, topic *Topic, msg *Event) {
+	body, err := rawBody(msg.Body)
+	if err != nil {
+		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
+		return
+	}
+
+	handled := m.deliver(uid, topic, msg.Topic, body)
+	if topic == nil {
+		return
+	}
+
+	sendAll(topic.clients, outbound{
+		text:  string(eventMust(msg.Topic, json.RawMessage(body))),
+		topic: msg.Topic,
+		lane:  lanePrivate,
+	}, handled)
+}
+
+// deliver numbers and retains the message for the sessions of the user and
+// returns the connections it was handled for.
+func (m *Sessions) deliver(uid string, topic *Topic, name string, body json.RawMessage) map[IClient]struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	sessions, ok := m.uids[uid]
+	if !ok {
+		return nil
+	}
+
+	handled := make(map[IClient]struct{}, len(sessions))
+	subscribed := func(c IClient) bool {
+		if c == nil || topic == nil {
+			return false
+		}
+		_, ok := topic.clients[c]
+		return ok
+	}
+
+	for s := range sessions {
+		switch {
+		case s.client != nil:
+			if !subscribed(s.client) {
+				continue
+			}
+			s.client.Send(s.retain(name, body, m.size))
+			handled[s.client] = struct{}{}
+
+		case subscribed(s.resuming):
+			s.retain(name, body, m.size)
+			handled[s.resuming] = struct{}{}
+
+		case contains(s.subscriptions, streamName(msg.ScopePrivate, name)):
+			s.retain(name, body, m.size)
+		}
+	}
+
+	return handled
+}
+
+// retain numbers the message and keeps the size last ones in the session.
+func (s *session) retain(name string, body json.RawMessage, size int) string {
+	s.seq++
+	text := sessionEnvelope(s.seq, name, body)
+
+	s.messages = append(s.messages, sessionMessage{s.seq, text})
+	if len(s.messages) > size {
+		s.messages = s.messages[len(s.messages)-size:]
+	}
+	return text
+}
+
+// sessionEnvelope returns the {"seq":N,"<topic>":<body>} message of a
+// session, the body is kept as received whatever its JSON type.
+func sessionEnvelope(seq int64, name string, body json.RawMessage) string {
+	key, err := json.Marshal(name)
+	if err != nil {
+		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
+	}
+
+	b := make([]byte, 0, len(body)+len(key)+32)
+	b = append(b, `{"seq":`...)
+	b = strconv.AppendInt(b, seq, 10)
+	b = append(b, ',')
+	b = append(b, key...)
+	b = append(b, ':')
+	b = append(b, body...)
+	b = append(b, '}')
+	return string(b)
+}
+
+func (s *session) since(seq int64) []string {
+	res := []string{}
+	for _, m := range s.messages {
+		if m.seq > seq {
+			res = append(res, m.message)
+		}
+	}
+	return res
+}
+
+// openSession starts the session of a new authenticated connection which
+// asked for one, or resumes the one given in the query. It returns the
+// subscriptions to restore, attachSession must be called once they are.
+func (h *Hub) openSession(c IClient, resume, lastSeq string) []string {
+	uid := c.GetAuth().UID
+	if h.Sessions == nil || uid == "" || (resume == "" && !sessionRequested(c)) {
+		return nil
+	}
+
+	// Private messages of the user are routed by this shard, none can be
+	// sent while the session is handed over.
+	sh := h.shardFor(uid)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if resume != "" {
+		s, missed, previous, err := h.resumeSession(c, resume, lastSeq)
+		if err == nil {
+			// The previous connections may not be closed yet, they stop
+			// receiving the messages of the session before the missed
+			// ones are replayed.
+			for _, p := range previous {
+				h.leavePrivateTopics(sh, uid, p)
+			}
+
+			metrics.RecordSessionResume("resumed")
+			c.Send(responseMust(nil, map[string]interface{}{
+				"message": "resumed",
+				"session": s.id,
+			}))
+			for _, m := range missed {
+				c.Send(m)
+			}
+			return s.subscriptions
+		}
+
+		metrics.RecordSessionResume("failed")
+		log.Info().Msgf("Session %s of %s not resumed: %s", resume, uid, err.Error())
+		c.Send(responseMust(errResumeFailed, nil))
+	}
+
+	s := h.Sessions.create(c)
+	c.Send(responseMust(nil, map[string]interface{}{
+		"message": "session created",
+		"session": s.id,
+	}))
+	return nil
+}
+
+// sessionRequested reports whether the client asked for a session, the
+// messages of the connections without one are sent as is.
+func sessionRequested(c IClient) bool {
+	r, ok := c.(sessionRequester)
+	return ok && r.sessionRequested()
+}
+
+func (h *Hub) resumeSession(c IClient, id, lastSeq string) (*session, []string, []IClient, error) {
+	seq, err := strconv.ParseInt(lastSeq, 10, 64)
+	if err != nil || seq < 0 {
+		return nil, nil, nil, errors.New("invalid last_seq")
+	}
+	return h.Sessions.resume(c, id, seq)
+}
+
+// leavePrivateTopics unsubscribes the connection from the private topics of
+// the user, the shard of the user must be locked.
+func (h *Hub) leavePrivateTopics(s *shard, uid string, c IClient) {
+	topics := s.privateTopics[uid]
+	for t, topic := range topics {
+		if topic.unsubscribe(c) {
+			metrics.RecordHubUnsubscription("private", t)
+			c.UnsubscribePrivate(streamName(msg.ScopePrivate, t))
+		}
+		if topic.len() == 0 {
+			delete(topics, t)
+		}
+	}
+
+	if len(topics) == 0 {
+		delete(s.privateTopics, uid)
+	}
+}
+
+// attachSession sends the messages received while the subscriptions of a
+// resumed session were restored.
+func (h *Hub) attachSession(c IClient) {
+	uid := c.GetAuth().UID
+	if h.Sessions == nil || uid == "" {
+		return
+	}
+
+	sh := h.shardFor(uid)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	for _, m := range h.Sessions.attach(c) {
+		c.Send(m)
+	}
+}
@@ -0,0 +1,248 @@
+package routing
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func orderEvent(id int) *Event {
+	return &Event{
+		Scope:  "private",
+		Stream: "UID123",
+		Type:   "order",
+		Topic:  "order",
+		Body:   map[string]interface{}{"id": id},
+	}
+}
+
+func sessionClient() *MockedClient {
+	c := &MockedClient{session: true}
+	c.On("GetAuth").Return(Auth{UID: "UID123"})
+	c.On("GetSubscriptions").Return([]string{"order"})
+	c.On("SubscribePrivate", "order").Return()
+	c.On("Send", mock.Anything).Return()
+	return c
+}
+
+// connect opens or resumes the session of the client and subscribes it to the
+// streams as NewClient does.
+func connect(h *Hub, c *MockedClient, resume, lastSeq string, streams ...string) {
+	restored := h.openSession(c, resume, lastSeq)
+	h.handleSubscribe(&Request{
+		client:  c,
+		Request: message.Request{Streams: append(restored, streams...)},
+	})
+	h.attachSession(c)
+}
+
+func sessionID(t *testing.T, response string) string {
+	var res struct {
+		Success struct {
+			Session string `json:"session"`
+		} `json:"success"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(response), &res))
+	require.NotEmpty(t, res.Success.Session)
+	return res.Success.Session
+}
+
+func TestSessionResume(t *testing.T) {
+	h := NewHub(nil)
+	h.Sessions = NewSessions(time.Minute, 10)
+
+	c := sessionClient()
+	connect(h, c, "", "", "order")
+	h.routeMessage(orderEvent(1))
+
+	sent := sentMessages(c)
+	require.Equal(t, 3, len(sent))
+	id := sessionID(t, sent[0])
+	assert.Equal(t, `{"seq":1,"order":{"id":1}}`, sent[2])
+
+	// Messages published while disconnected are retained
+	h.unsubscribeAll(c)
+	h.routeMessage(orderEvent(2))
+	h.routeMessage(orderEvent(3))
+
+	c2 := sessionClient()
+	connect(h, c2, id, "1")
+	h.routeMessage(orderEvent(4))
+
+	assert.Equal(t, []string{
+		`{"success":{"message":"resumed","session":"` + id + `"}}`,
+		`{"seq":2,"order":{"id":2}}`,
+		`{"seq":3,"order":{"id":3}}`,
+		`{"success":{"message":"subscribed","streams":["order"]}}`,
+		`{"seq":4,"order":{"id":4}}`,
+	}, sentMessages(c2))
+
+	t.Run("messages received while subscriptions are restored", func(t *testing.T) {
+		h.unsubscribeAll(c2)
+
+		c3 := sessionClient()
+		restored := h.openSession(c3, id, "4")
+		h.handleSubscribe(&Request{
+			client:  c3,
+			Request: message.Request{Streams: restored},
+		})
+		h.routeMessage(orderEvent(5))
+		h.attachSession(c3)
+		h.routeMessage(orderEvent(6))
+
+		assert.Equal(t, []string{
+			`{"success":{"message":"resumed","session":"` + id + `"}}`,
+			`{"success":{"message":"subscribed","streams":["order"]}}`,
+			`{"seq":5,"order":{"id":5}}`,
+			`{"seq":6,"order":{"id":6}}`,
+		}, sentMessages(c3))
+		h.unsubscribeAll(c3)
+	})
+
+	t.Run("previous connection not closed yet", func(t *testing.T) {
+		c := sessionClient()
+		c.On("UnsubscribePrivate", "order").Return()
+		connect(h, c, id, "6")
+
+		c2 := sessionClient()
+		connect(h, c2, id, "6")
+		h.routeMessage(orderEvent(7))
+
+		assert.Equal(t, `{"success":{"message":"resumed","session":"`+id+`"}}`, sentMessages(c)[0])
+		assert.Equal(t, 2, len(sentMessages(c)))
+		assert.Equal(t, `{"seq":7,"order":{"id":7}}`, sentMessages(c2)[2])
+		c.AssertCalled(t, "UnsubscribePrivate", "order")
+	})
+
+	t.Run("unknown session", func(t *testing.T) {
+		c := sessionClient()
+		connect(h, c, "unknown", "1")
+
+		sent := sentMessages(c)
+		require.Equal(t, 3, len(sent))
+		assert.Equal(t, `{"error":"resume failed"}`, sent[0])
+		assert.NotEqual(t, id, sessionID(t, sent[1]))
+	})
+}
+
+func TestSessionResumeFailed(t *testing.T) {
+	h := NewHub(nil)
+	h.Sessions = NewSessions(50*time.Millisecond, 2)
+
+	c := sessionClient()
+	connect(h, c, "", "", "order")
+	id := sessionID(t, sentMessages(c)[0])
+	h.unsubscribeAll(c)
+
+	for i := 1; i <= 3; i++ {
+		h.routeMessage(orderEvent(i))
+	}
+
+	t.Run("missed messages are no longer retained", func(t *testing.T) {
+		c := sessionClient()
+		h.openSession(c, id, "0")
+		assert.Equal(t, `{"error":"resume failed"}`, sentMessages(c)[0])
+	})
+
+	t.Run("session of another user", func(t *testing.T) {
+		c := &MockedClient{}
+		c.On("GetAuth").Return(Auth{UID: "UID456"})
+		c.On("Send", mock.Anything).Return()
+		h.openSession(c, id, "3")
+		assert.Equal(t, `{"error":"resume failed"}`, sentMessages(c)[0])
+	})
+
+	t.Run("grace window passed", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			h.Sessions.mutex.Lock()
+			defer h.Sessions.mutex.Unlock()
+			_, ok := h.Sessions.sessions[id]
+			return !ok
+		}, time.Second, 5*time.Millisecond)
+
+		c := sessionClient()
+		h.openSession(c, id, "3")
+		assert.Equal(t, `{"error":"resume failed"}`, sentMessages(c)[0])
+	})
+}
+
+func TestSessionEnvelope(t *testing.T) {
+	h := NewHub(nil)
+	h.Sessions = NewSessions(time.Minute, 10)
+
+	c := sessionClient()
+	connect(h, c, "", "", "order")
+
+	for _, body := range []interface{}{
+		json.RawMessage(`[1, 2]`),
+		json.RawMessage(`"done"`),
+		json.RawMessage(`{"b":1,"a":2}`),
+	} {
+		h.routeMessage(&Event{Scope: "private", Stream: "UID123", Type: "order", Topic: "order", Body: body})
+	}
+
+	// Bodies are forwarded as received, after the sequence number
+	assert.Equal(t, []string{
+		`{"seq":1,"order":[1, 2]}`,
+		`{"seq":2,"order":"done"}`,
+		`{"seq":3,"order":{"b":1,"a":2}}`,
+	}, sentMessages(c)[2:])
+}
+
+func TestSessionResumeDottedTopic(t *testing.T) {
+	h := NewHub(nil)
+	h.Sessions = NewSessions(time.Minute, 10)
+
+	eurOrder := func(id int) *Event {
+		return &Event{Scope: "private", Stream: "UID123", Type: "order", Topic: "eur.order", Body: map[string]interface{}{"id": id}}
+	}
+	dottedClient := func() *MockedClient {
+		c := &MockedClient{session: true}
+		c.On("GetAuth").Return(Auth{UID: "UID123"})
+		c.On("GetSubscriptions").Return([]string{"private:eur.order"})
+		c.On("SubscribePrivate", "private:eur.order").Return()
+		c.On("Send", mock.Anything).Return()
+		return c
+	}
+
+	c := dottedClient()
+	connect(h, c, "", "", "private:eur.order")
+	id := sessionID(t, sentMessages(c)[0])
+	h.unsubscribeAll(c)
+
+	// Messages of the subscriptions are retained whatever the syntax of
+	// their stream name
+	h.routeMessage(eurOrder(1))
+
+	c2 := dottedClient()
+	connect(h, c2, id, "0")
+	assert.Equal(t, []string{
+		`{"success":{"message":"resumed","session":"` + id + `"}}`,
+		`{"seq":1,"eur.order":{"id":1}}`,
+		`{"success":{"message":"subscribed","streams":["private:eur.order"]}}`,
+	}, sentMessages(c2))
+}
+
+func TestSessionOptIn(t *testing.T) {
+	h := NewHub(nil)
+	h.Sessions = NewSessions(time.Minute, 10)
+
+	c := sessionClient()
+	c.session = false
+	connect(h, c, "", "", "order")
+	c2 := sessionClient()
+	connect(h, c2, "", "", "order")
+	h.routeMessage(orderEvent(1))
+
+	// Connections without session receive the private messages as is
+	assert.Equal(t, []string{
+		`{"success":{"message":"subscribed","streams":["order"]}}`,
+		`{"order":{"id":1}}`,
+	}, sentMessages(c))
+	assert.Equal(t, `{"seq":1,"order":{"id":1}}`, sentMessages(c2)[2])
+}
@@ -0,0 +1,112 @@
+package routing
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Number of partitions of the hub topic registries.
+var shardsCount = 64
+
+// Number of events buffered per shard before ReceiveMsg blocks.
+var shardEventsBuffer = 1024
+
+// shard holds a partition of the hub topics and incremental objects.
+// Each shard has its own lock and its own routing goroutine, so that a busy
+// topic only slows down the topics sharing the same shard.
+type shard struct {
+	// List of clients registered to public topics
+	publicTopics map[string]*Topic
+
+	// List of clients registered to private topics
+	privateTopics map[string]map[string]*Topic
+
+	// map[prefix -> map[topic -> *Topic]]
+	prefixedTopics map[string]map[string]*Topic
+
+	// Storage for incremental objects
+	incrementalObjects incrementalObjects
+
+	// map[UID -> incremental objects] of the private topics
+	privateObjects map[string]*privateObjects
+
+	// map[scope -> incremental objects] of the prefixed topics
+	prefixedObjects map[string]incrementalObjects
+
+	// map[base topic -> map[stream -> *Topic]] of the derived streams
+	derived map[string]map[string]*Topic
+
+	// map[topic -> last message] of the cached topics, prefixed topics
+	// are keyed by their scoped name
+	lastValues map[string]*lastValue
+
+	// map[topic -> last messages] of the topics with a history, keyed like
+	// lastValues
+	history map[string]*historyBuffer
+
+	// map[pattern -> *pattern] of the wildcard subscriptions, every shard
+	// knows all the patterns
+	patterns map[string]*pattern
+
+	// map[topic -> patterns matching it] of the topics routed so far
+	matches map[scopedTopic][]*pattern
+
+	// Events waiting to be routed by the shard goroutine
+	events chan *Event
+
+	mutex sync.Mutex
+}
+
+func newShard() *shard {
+	return &shard{
+		publicTopics:       make(map[string]*Topic, 10),
+		privateTopics:      make(map[string]map[string]*Topic, 100),
+		prefixedTopics:     make(map[string]map[string]*Topic, 10),
+		incrementalObjects: make(incrementalObjects, 5),
+		privateObjects:     make(map[string]*privateObjects),
+		prefixedObjects:    make(map[string]incrementalObjects),
+		derived:            make(map[string]map[string]*Topic),
+		lastValues:         make(map[string]*lastValue),
+		history:            make(map[string]*historyBuffer),
+		patterns:           make(map[string]*pattern),
+		matches:            make(map[scopedTopic][]*pattern),
+		events:             make(chan *Event, shardEventsBuffer),
+	}
+}
+
+// shardFor returns the shard owning the given key.
+// Public and prefixed topics are keyed by their unprefixed topic name, private
+// topics by the user UID.
+func (h *Hub) shardFor(key string) *shard {
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
+
+func eventShardKey(msg *Event) string {
+	if msg.Scope == "private" {
+		return msg.Stream
+	}
+	return msg.Topic
+}
+
+// dispatch queues the event on the shard owning its topic.
+func (h *Hub) dispatch(msg *Event) {
+	h.shardFor(eventShardKey(msg)).events <- msg
+}
+
+func (h *Hub) routeShardEvents(s *shard) {
+	for msg := range s.events {
+		h.routeMessage(msg)
+	}
+}
+
+// scopeObjects returns the incremental objects of a prefixed scope.
+func (s *shard) scopeObjects(scope string) incrementalObjects {
+	objects, ok := s.prefixedObjects[scope]
+	if !ok {
+		objects = make(incrementalObjects, 1)
+		s.prefixedObjects[scope] = objects
+	}
+	return objects
+}
@@ -0,0 +1,348 @@
+package routing
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	msg "github.com/openware/rango/pkg/message"
+	"github.com/openware/rango/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// SlowConsumerPolicy makes room in the full public or prefixed lane of a
+// client which does not read its messages fast enough. The connection is
+// closed if the policy cannot drop any message, the hub never waits for a
+// client.
+//
+// Responses and the messages of incremental topics are never dropped, a
+// client missing one of them would be left with an inconsistent state.
+type SlowConsumerPolicy interface {
+	// Name of the policy, as configured and reported in the metrics
+	Name() string
+
+	// overflow returns the queued messages kept and the action taken
+	overflow(queue []outbound) ([]outbound, string)
+}
+
+const (
+	slowConsumerDisconnect = "disconnect"
+	slowConsumerDrop       = "drop"
+	slowConsumerConflate   = "conflate"
+)
+
+// NewSlowConsumerPolicy returns the policy of the given name: disconnect,
+// drop-oldest, conflate or drop-public.
+func NewSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	switch name {
+	case "", "disconnect":
+		return disconnectPolicy{}, nil
+	case "drop-oldest":
+		return dropOldestPolicy{}, nil
+	case "conflate":
+		return conflatePolicy{}, nil
+	case "drop-public":
+		return dropPublicPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown slow consumer policy: %s", name)
+	}
+}
+
+// disconnectPolicy closes the connection as soon as its queue is full.
+type disconnectPolicy struct{}
+
+func (disconnectPolicy) Name() string { return "disconnect" }
+
+func (disconnectPolicy) overflow(queue []outbound) ([]outbound, string) {
+	return queue, slowConsumerDisconnect
+}
+
+// dropOldestPolicy drops the oldest message which can be dropped.
+type dropOldestPolicy struct{}
+
+func (dropOldestPolicy) Name() string { return "drop-oldest" }
+
+func (dropOldestPolicy) overflow(queue []outbound) ([]outbound, string) {
+	return dropFirst(queue, droppable), slowConsumerDrop
+}
+
+// dropPublicPolicy drops the oldest message of a public topic, the prefixed
+// messages are always delivered.
+type dropPublicPolicy struct{}
+
+func (dropPublicPolicy) Name() string { return "drop-public" }
+
+func (dropPublicPolicy) overflow(queue []outbound) ([]outbound, string) {
+	return dropFirst(queue, func(m outbound) bool {
+		return droppable(m) && m.lane == lanePublic
+	}), slowConsumerDrop
+}
+
+// conflatePolicy keeps the last queued message of each topic.
+type conflatePolicy struct{}
+
+func (conflatePolicy) Name() string { return "conflate" }
+
+func (conflatePolicy) overflow(queue []outbound) ([]outbound, string) {
+	last := make(map[string]int)
+	for i, m := range queue {
+		if droppable(m) {
+			last[m.topic] = i
+		}
+	}
+
+	kept := queue[:0]
+	for i, m := range queue {
+		if droppable(m) && last[m.topic] != i {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept, slowConsumerConflate
+}
+
+// droppable reports whether a message can be dropped without breaking the
+// state of the client, the responses have no topic.
+func droppable(m outbound) bool {
+	if m.topic == "" {
+		return false
+	}
+	base := msg.StreamBase(m.topic)
+	return !isIncrementObject(base) && !isSnapshotObject(base)
+}
+
+func dropFirst(queue []outbound, drop func(outbound) bool) []outbound {
+	for i, m := range queue {
+		if drop(m) {
+			return append(queue[:i], queue[i+1:]...)
+		}
+	}
+	return queue
+}
+
+// Lanes of the outbound messages, written by priority: the private messages
+// and the responses first, then the prefixed and the public ones.
+const (
+	lanePrivate = iota
+	lanePrefixed
+	lanePublic
+	laneCount
+)
+
+// laneOf returns the lane of the messages of a topic scope.
+func laneOf(scope string) int {
+	switch scope {
+	case "", msg.ScopePublic:
+		return lanePublic
+	case msg.ScopePrivate:
+		return lanePrivate
+	default:
+		return lanePrefixed
+	}
+}
+
+// lane is a FIFO of messages, popped from head.
+type lane struct {
+	messages []outbound
+	head     int
+}
+
+func (l *lane) len() int {
+	return len(l.messages) - l.head
+}
+
+func (l *lane) pop() outbound {
+	m := l.messages[l.head]
+	l.messages[l.head] = outbound{}
+	l.head++
+	if l.head == len(l.messages) {
+		l.messages = l.messages[:0]
+		l.head = 0
+	}
+	return m
+}
+
+// compact moves the queued messages to the start of the array.
+func (l *lane) compact() {
+	if l.head == 0 {
+		return
+	}
+	n := copy(l.messages, l.messages[l.head:])
+	for i := n; i < len(l.messages); i++ {
+		l.messages[i] = outbound{}
+	}
+	l.messages = l.messages[:n]
+	l.head = 0
+}
+
+// Number of times the size of the other lanes the private lane can hold, a
+// client which does not read its responses and private messages is closed
+// beyond.
+const privateLaneFactor = 16
+
+// sendQueue holds the messages of a client until they are written to its
+// websocket. Pushing a message never blocks: the slow consumer policy is
+// applied when the prefixed or public lane is full, the private lane is
+// given more room and the connection is only closed when it is exceeded.
+type sendQueue struct {
+	mutex  sync.Mutex
+	lanes  [laneCount]lane
+	size   int
+	policy SlowConsumerPolicy
+
+	// Set when the hub closed the queue or the connection is closed with a
+	// close code, the code is zero in the first case
+	closed      bool
+	closeCode   int
+	closeReason string
+
+	// Signaled when messages are queued or the queue is closed
+	ready chan struct{}
+}
+
+func newSendQueue(size int, policy SlowConsumerPolicy) *sendQueue {
+	if policy == nil {
+		policy = disconnectPolicy{}
+	}
+
+	return &sendQueue{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (q *sendQueue) push(m outbound) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	l := &q.lanes[m.lane]
+	switch {
+	case m.lane == lanePrivate && l.len() >= privateLaneFactor*q.size:
+		log.Warn().Msg("Closing slow websocket connection: private lane full")
+		metrics.RecordSlowConsumer(q.policy.Name(), slowConsumerDisconnect, 1)
+		q.abort(websocket.ClosePolicyViolation, "slow consumer")
+		return
+	case m.lane != lanePrivate && l.len() >= q.size && !q.overflow(l):
+		return
+	}
+
+	l.messages = append(l.messages, m)
+	q.notify()
+}
+
+// overflow applies the policy to a full lane, it returns false if the
+// connection is closed.
+func (q *sendQueue) overflow(l *lane) bool {
+	l.compact()
+	n := len(l.messages)
+	kept, action := q.policy.overflow(l.messages)
+
+	// Release the messages dropped from the end of the array
+	for i := len(kept); i < n; i++ {
+		l.messages[i] = outbound{}
+	}
+	l.messages = kept
+
+	if len(kept) >= q.size {
+		log.Warn().Msgf("Closing slow websocket connection (%s)", q.policy.Name())
+		metrics.RecordSlowConsumer(q.policy.Name(), slowConsumerDisconnect, 1)
+		q.abort(websocket.ClosePolicyViolation, "slow consumer")
+		return false
+	}
+
+	metrics.RecordSlowConsumer(q.policy.Name(), action, n-len(kept))
+	return true
+}
+
+func (q *sendQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// abort drops the queued messages and closes the connection with the code.
+func (q *sendQueue) abort(code int, reason string) {
+	q.lanes = [laneCount]lane{}
+	q.closed = true
+	q.closeCode = code
+	q.closeReason = reason
+	q.notify()
+}
+
+// disconnect closes the connection with the code, without writing the
+// queued messages but the notice if not empty.
+func (q *sendQueue) disconnect(code int, reason, notice string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.abort(code, reason)
+	if notice != "" {
+		l := &q.lanes[lanePrivate]
+		l.messages = append(l.messages, outbound{text: notice, unbatched: true})
+	}
+}
+
+// close closes the queue once the messages queued are written.
+func (q *sendQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.notify()
+}
+
+// pop returns the next message by priority, false if the queue is empty.
+func (q *sendQueue) pop() (outbound, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i := range q.lanes {
+		if q.lanes[i].len() > 0 {
+			return q.lanes[i].pop(), true
+		}
+	}
+	return outbound{}, false
+}
+
+// popBatched returns the next message by priority if it can be batched in
+// the room left in a frame, false otherwise.
+func (q *sendQueue) popBatched(room int) (outbound, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i := range q.lanes {
+		l := &q.lanes[i]
+		if l.len() == 0 {
+			continue
+		}
+		if m := l.messages[l.head]; m.unbatched || len(m.text) > room {
+			return outbound{}, false
+		}
+		return l.pop(), true
+	}
+	return outbound{}, false
+}
+
+// done reports whether the queue is closed and empty, with the close code and
+// reason of the connection.
+func (q *sendQueue) done() (bool, int, string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for i := range q.lanes {
+		if q.lanes[i].len() > 0 {
+			return false, 0, ""
+		}
+	}
+	return q.closed, q.closeCode, q.closeReason
+}
@@ -0,0 +1,164 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func queuedTexts(q *sendQueue) []string {
+	texts := []string{}
+	for {
+		m, ok := q.pop()
+		if !ok {
+			return texts
+		}
+		texts = append(texts, m.text)
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	queued := []outbound{
+		{text: "snapshot", lane: lanePublic},
+		{text: "trades-1", topic: "eurusd.trades", lane: lanePublic},
+		{text: "tickers-1", topic: "eurusd.tickers", lane: lanePublic},
+		{text: "ob-1", topic: "eurusd.ob-inc", lane: lanePublic},
+		{text: "trades-2", topic: "eurusd.trades", lane: lanePublic},
+		{text: "tickers-2", topic: "eurusd.tickers", lane: lanePublic},
+	}
+
+	for name, expected := range map[string][]string{
+		"drop-oldest": {"snapshot", "tickers-1", "ob-1", "trades-2", "tickers-2", "trades-3"},
+		"drop-public": {"snapshot", "tickers-1", "ob-1", "trades-2", "tickers-2", "trades-3"},
+		"conflate":    {"snapshot", "ob-1", "trades-2", "tickers-2", "trades-3"},
+	} {
+		policy, err := NewSlowConsumerPolicy(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, policy.Name())
+
+		q := newSendQueue(len(queued), policy)
+		for _, m := range queued {
+			q.push(m)
+		}
+		q.push(outbound{text: "trades-3", topic: "eurusd.trades", lane: lanePublic})
+
+		assert.Equal(t, expected, queuedTexts(q), name)
+		closed, _, _ := q.done()
+		assert.False(t, closed, name)
+	}
+
+	t.Run("prefixed messages are kept by drop-public", func(t *testing.T) {
+		q := newSendQueue(1, dropPublicPolicy{})
+		q.push(outbound{text: "sys-1", topic: "eurusd.sys", lane: lanePrefixed})
+		q.push(outbound{text: "sys-2", topic: "eurusd.sys", lane: lanePrefixed})
+		closed, code, _ := q.done()
+		assert.True(t, closed)
+		assert.Equal(t, websocket.ClosePolicyViolation, code)
+		assert.Empty(t, queuedTexts(q))
+
+		q = newSendQueue(1, dropOldestPolicy{})
+		q.push(outbound{text: "sys-1", topic: "eurusd.sys", lane: lanePrefixed})
+		q.push(outbound{text: "sys-2", topic: "eurusd.sys", lane: lanePrefixed})
+		assert.Equal(t, []string{"sys-2"}, queuedTexts(q))
+	})
+
+	t.Run("incremental messages are never dropped", func(t *testing.T) {
+		q := newSendQueue(1, dropOldestPolicy{})
+		q.push(outbound{text: "ob-1", topic: "eurusd.ob-inc@20", lane: lanePublic})
+		q.push(outbound{text: "ob-2", topic: "eurusd.ob-inc@20", lane: lanePublic})
+		closed, _, _ := q.done()
+		assert.True(t, closed)
+	})
+
+	_, err := NewSlowConsumerPolicy("block")
+	assert.EqualError(t, err, "unknown slow consumer policy: block")
+}
+
+func TestPriorityLanes(t *testing.T) {
+	q := newSendQueue(2, nil)
+	q.push(outbound{text: "trades-1", topic: "eurusd.trades", lane: lanePublic})
+	q.push(outbound{text: "sys-1", topic: "eurusd.sys", lane: lanePrefixed})
+	q.push(outbound{text: "order-1", topic: "order", lane: lanePrivate})
+	q.push(outbound{text: "response"})
+	q.push(outbound{text: "trades-2", topic: "eurusd.trades", lane: lanePublic})
+
+	m, ok := q.pop()
+	require.True(t, ok)
+	assert.Equal(t, "order-1", m.text)
+
+	// Messages queued meanwhile are popped by priority
+	q.push(outbound{text: "order-2", topic: "order", lane: lanePrivate})
+	assert.Equal(t, []string{"response", "order-2", "sys-1", "trades-1", "trades-2"}, queuedTexts(q))
+
+	t.Run("private lane", func(t *testing.T) {
+		q := newSendQueue(1, nil)
+		for i := 0; i < privateLaneFactor; i++ {
+			q.push(outbound{text: "order", topic: "order", lane: lanePrivate})
+		}
+		closed, _, _ := q.done()
+		assert.False(t, closed)
+
+		// Responses are not bounded by the slow consumer policy but the
+		// connection is closed at the hard limit
+		q.push(outbound{text: "pong"})
+		closed, code, _ := q.done()
+		assert.True(t, closed)
+		assert.Equal(t, websocket.ClosePolicyViolation, code)
+	})
+
+	t.Run("private messages do not fill the other lanes", func(t *testing.T) {
+		q := newSendQueue(1, nil)
+		for i := 0; i < 3; i++ {
+			q.push(outbound{text: "order", topic: "order", lane: lanePrivate})
+		}
+		closed, _, _ := q.done()
+		assert.False(t, closed)
+
+		q.push(outbound{text: "trades-1", topic: "eurusd.trades", lane: lanePublic})
+		q.push(outbound{text: "trades-2", topic: "eurusd.trades", lane: lanePublic})
+		closed, code, _ := q.done()
+		assert.True(t, closed)
+		assert.Equal(t, websocket.ClosePolicyViolation, code)
+	})
+
+	t.Run("hub messages", func(t *testing.T) {
+		h := NewHub(nil)
+		c := &Client{hub: h, send: newSendQueue(maxBufferedMessages, nil), Auth: Auth{UID: "UID123"}}
+		h.subscribePublic("eurusd.trades", &Request{client: c})
+		h.subscribePrivate("order", &Request{client: c})
+
+		h.routeMessage(tradeEvent("public", 1))
+		h.routeMessage(orderEvent(1))
+		assert.Equal(t, []string{`{"order":{"id":1}}`, `{"eurusd.trades":{"tid":1}}`}, queuedTexts(c.send))
+	})
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	h := NewHub(nil)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+
+		c := &Client{hub: h, conn: conn, send: newSendQueue(2, h.SlowConsumerPolicy)}
+		for i := 0; i < 3; i++ {
+			c.sendEvent(outbound{text: `{"eurusd.trades":{}}`, topic: "eurusd.trades", lane: lanePublic})
+		}
+		c.write()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+}
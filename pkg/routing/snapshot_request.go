@@ -0,0 +1,155 @@
+package routing
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openware/rango/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// Number of requested topics above which the ones requested before the last
+// interval are forgotten.
+var maxRequestedTopics = 1024
+
+// Number of snapshot requests waiting to be pushed above which new requests
+// are dropped.
+var maxQueuedRequests = 256
+
+// Publisher pushes messages to the upstream, it is implemented by
+// amqp.AMQPSession.
+type Publisher interface {
+	Push(ex, rt string, data []byte) error
+}
+
+// SnapshotRequester asks the upstream to publish a fresh snapshot of an
+// incremental topic. Requests are de-duplicated and sent at most once per
+// interval for each topic, they are pushed one at a time by a single
+// goroutine since the confirmations of the AMQP channel are shared.
+type SnapshotRequester struct {
+	publisher  Publisher
+	exchange   string
+	routingKey string
+	interval   time.Duration
+
+	// Last request time per topic
+	requested map[string]time.Time
+
+	// Topics with a request being pushed
+	inflight map[string]bool
+
+	// Requests waiting to be pushed
+	queue chan snapshotPush
+
+	now   func() time.Time
+	mutex sync.Mutex
+}
+
+type snapshotPush struct {
+	key   string
+	topic string
+	body  []byte
+}
+
+// SnapshotRequest is the body of the message published to the upstream.
+type SnapshotRequest struct {
+	Scope  string `json:"scope"`
+	Stream string `json:"stream"`
+	Type   string `json:"type"`
+	Topic  string `json:"topic"`
+}
+
+func NewSnapshotRequester(p Publisher, exchange, routingKey string, interval time.Duration) *SnapshotRequester {
+	r := &SnapshotRequester{
+		publisher:  p,
+		exchange:   exchange,
+		routingKey: routingKey,
+		interval:   interval,
+		requested:  make(map[string]time.Time),
+		inflight:   make(map[string]bool),
+		queue:      make(chan snapshotPush, maxQueuedRequests),
+		now:        time.Now,
+	}
+	go r.push()
+	return r
+}
+
+// Request publishes a snapshot request for the topic of the increment unless
+// one was already sent during the last interval. The message is pushed in
+// the background since Push blocks until the upstream confirms it.
+func (r *SnapshotRequester) Request(msg *Event) bool {
+	// Private topics are requested per user
+	key := msg.Scope + "." + msg.Topic
+	if msg.Scope == "private" {
+		key = msg.Scope + "." + msg.Stream + "." + msg.Topic
+	}
+
+	r.mutex.Lock()
+	now := r.now()
+	if len(r.requested) > maxRequestedTopics {
+		r.prune(now)
+	}
+	if r.inflight[key] || now.Sub(r.requested[key]) < r.interval {
+		r.mutex.Unlock()
+		return false
+	}
+	r.inflight[key] = true
+	r.requested[key] = now
+	r.mutex.Unlock()
+
+	body, err := json.Marshal(SnapshotRequest{
+		Scope:  msg.Scope,
+		Stream: msg.Stream,
+		Type:   strings.Replace(msg.Type, "-inc", "-snap", 1),
+		Topic:  msg.Topic,
+	})
+	if err != nil {
+		log.Error().Msgf("Failed to marshal snapshot request: %s", err.Error())
+		r.done(key)
+		return false
+	}
+
+	select {
+	case r.queue <- snapshotPush{key: key, topic: msg.Topic, body: body}:
+	default:
+		// Requested again with the next increment
+		log.Warn().Msgf("Snapshot request of %s dropped: too many requests pending", msg.Topic)
+		r.mutex.Lock()
+		delete(r.requested, key)
+		delete(r.inflight, key)
+		r.mutex.Unlock()
+		return false
+	}
+
+	metrics.RecordSnapshotRequest(msg.Topic)
+	return true
+}
+
+// push sends the queued requests to the upstream, waiting for the
+// confirmation of each before the next.
+func (r *SnapshotRequester) push() {
+	for p := range r.queue {
+		log.Info().Msgf("Requesting snapshot of %s", p.topic)
+		if err := r.publisher.Push(r.exchange, r.routingKey, p.body); err != nil {
+			log.Error().Msgf("Snapshot request of %s failed: %s", p.topic, err.Error())
+		}
+		r.done(p.key)
+	}
+}
+
+// prune forgets the topics requested before the last interval.
+func (r *SnapshotRequester) prune(now time.Time) {
+	for key, t := range r.requested {
+		if now.Sub(t) >= r.interval {
+			delete(r.requested, key)
+		}
+	}
+}
+
+func (r *SnapshotRequester) done(key string) {
+	r.mutex.Lock()
+	delete(r.inflight, key)
+	r.mutex.Unlock()
+}
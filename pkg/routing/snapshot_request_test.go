@@ -0,0 +1,171 @@
+package routing
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pushed struct {
+	exchange   string
+	routingKey string
+	body       string
+}
+
+type fakePublisher struct {
+	pushes chan pushed
+}
+
+func (p *fakePublisher) Push(ex, rt string, data []byte) error {
+	p.pushes <- pushed{ex, rt, string(data)}
+	return nil
+}
+
+func (p *fakePublisher) next(t *testing.T) pushed {
+	select {
+	case m := <-p.pushes:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("no snapshot request pushed")
+	}
+	return pushed{}
+}
+
+func TestSnapshotRequester(t *testing.T) {
+	p := &fakePublisher{pushes: make(chan pushed, 10)}
+	r := NewSnapshotRequester(p, "peatio.events.snapshots", "snapshot.request", 5*time.Second)
+	now := time.Unix(1588000000, 0)
+	r.now = func() time.Time { return now }
+
+	inc := &Event{
+		Scope:  "public",
+		Stream: "eurusd",
+		Type:   "ob-inc",
+		Topic:  "eurusd.ob-inc",
+	}
+
+	require.True(t, r.Request(inc))
+	assert.Equal(t, pushed{
+		exchange:   "peatio.events.snapshots",
+		routingKey: "snapshot.request",
+		body:       `{"scope":"public","stream":"eurusd","type":"ob-snap","topic":"eurusd.ob-inc"}`,
+	}, p.next(t))
+
+	// Rate limited per topic
+	now = now.Add(time.Second)
+	assert.False(t, r.Request(inc))
+	assert.True(t, r.Request(&Event{
+		Scope:  "public",
+		Stream: "btcusd",
+		Type:   "ob-inc",
+		Topic:  "btcusd.ob-inc",
+	}))
+	p.next(t)
+
+	now = now.Add(5 * time.Second)
+	require.Eventually(t, func() bool {
+		return r.Request(inc)
+	}, time.Second, 10*time.Millisecond)
+	p.next(t)
+}
+
+func TestSnapshotRequestedOnMissingSnapshot(t *testing.T) {
+	p := &fakePublisher{pushes: make(chan pushed, 10)}
+	h := NewHub(nil)
+	h.SnapshotRequester = NewSnapshotRequester(p, "ex", "snapshot.request", time.Minute)
+
+	h.routeMessage(countEvent("count-inc", 11))
+	h.routeMessage(countEvent("count-inc", 12))
+	assert.Equal(t, `{"scope":"public","stream":"abc","type":"count-snap","topic":"abc.count-inc"}`, p.next(t).body)
+
+	// A gap marks the topic stale and requests a new snapshot
+	h.SnapshotRequester = NewSnapshotRequester(p, "ex", "snapshot.request", time.Minute)
+	h.routeMessage(countEvent("count-snap", 12))
+	h.routeMessage(countEvent("count-inc", 14))
+	h.routeMessage(countEvent("count-inc", 15))
+	p.next(t)
+
+	select {
+	case <-p.pushes:
+		t.Fatal("snapshot request must be sent once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPrivateSnapshotRequests(t *testing.T) {
+	p := &fakePublisher{pushes: make(chan pushed, 10)}
+	h := NewHub(nil)
+	h.SnapshotRequester = NewSnapshotRequester(p, "ex", "snapshot.request", time.Minute)
+
+	h.routeMessage(balancesEvent("UID123", "balances-inc", map[string]interface{}{}))
+	assert.Equal(t, `{"scope":"private","stream":"UID123","type":"balances-snap","topic":"balances-inc"}`, p.next(t).body)
+
+	// Requests are rate limited per user
+	h.routeMessage(balancesEvent("UID456", "balances-inc", map[string]interface{}{}))
+	assert.Equal(t, `{"scope":"private","stream":"UID456","type":"balances-snap","topic":"balances-inc"}`, p.next(t).body)
+}
+
+// serialPublisher records the highest number of concurrent pushes.
+type serialPublisher struct {
+	release chan struct{}
+	active  int
+	max     int
+	pushed  int
+	mutex   sync.Mutex
+}
+
+func (p *serialPublisher) Push(ex, rt string, data []byte) error {
+	p.mutex.Lock()
+	p.active++
+	if p.active > p.max {
+		p.max = p.active
+	}
+	p.mutex.Unlock()
+
+	<-p.release
+
+	p.mutex.Lock()
+	p.active--
+	p.pushed++
+	p.mutex.Unlock()
+	return nil
+}
+
+func TestSnapshotRequestsSerialized(t *testing.T) {
+	defer func(n int) { maxQueuedRequests = n }(maxQueuedRequests)
+	maxQueuedRequests = 3
+
+	p := &serialPublisher{release: make(chan struct{})}
+	r := NewSnapshotRequester(p, "ex", "snapshot.request", time.Minute)
+
+	request := func(i int) bool {
+		return r.Request(&Event{Scope: "public", Stream: fmt.Sprint("market", i), Type: "ob-inc", Topic: fmt.Sprint("market", i, ".ob-inc")})
+	}
+
+	// One request is being pushed and three are queued, the next is dropped
+	require.True(t, request(0))
+	require.Eventually(t, func() bool {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return p.active == 1
+	}, time.Second, time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		require.True(t, request(i))
+	}
+	assert.False(t, request(4))
+
+	close(p.release)
+	require.Eventually(t, func() bool {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return p.pushed == 4
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 1, p.max)
+
+	// The dropped request is not rate limited
+	assert.True(t, request(4))
+}
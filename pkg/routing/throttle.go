@@ -0,0 +1,169 @@
+package routing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/openware/rango/pkg/orderbook"
+	"github.com/rs/zerolog/log"
+)
+
+// Bounds of the throttle interval of a stream, e.g. global.tickers@1s.
+var (
+	minThrottle = 10 * time.Millisecond
+	maxThrottle = time.Minute
+)
+
+// conflater limits the messages of a throttled topic to one per interval.
+// Order book increments received during the interval are merged by price
+// level, any other message replaces the pending one.
+type conflater struct {
+	topic    *Topic
+	mutex    *sync.Mutex
+	interval time.Duration
+
+	pending bool
+	value   interface{}
+	update  *orderbook.Update
+
+	// map[client -> replay of the state] of the subscribers which joined
+	// while a message was pending, they get the state at the flush
+	joining map[IClient]func() bool
+
+	last  time.Time
+	timer *time.Timer
+	now   func() time.Time
+}
+
+// newConflater creates the conflater of a topic, mutex is the lock of the
+// shard owning the topic and is held while a delayed message is flushed.
+func newConflater(topic *Topic, mutex *sync.Mutex, interval time.Duration) *conflater {
+	return &conflater{
+		topic:    topic,
+		mutex:    mutex,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// push replaces the pending message with the body of the last event.
+func (c *conflater) push(body interface{}) {
+	c.value = body
+	c.update = nil
+	c.pending = true
+	c.schedule()
+}
+
+// merge adds the levels of an order book increment to the pending message.
+func (c *conflater) merge(u *orderbook.Update) {
+	if c.update == nil {
+		c.update = &orderbook.Update{}
+	}
+	c.update.Merge(u)
+	c.value = nil
+	c.pending = true
+	c.schedule()
+}
+
+// schedule sends the pending message right away if the interval since the
+// last one is over, otherwise at the end of the interval.
+func (c *conflater) schedule() {
+	if c.timer != nil {
+		return
+	}
+
+	wait := c.interval - c.now().Sub(c.last)
+	if wait <= 0 {
+		c.flush()
+		return
+	}
+
+	last := c.last
+	c.timer = time.AfterFunc(wait, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		c.timer = nil
+		if c.last != last && c.pending {
+			// The interval was restarted by a replay meanwhile
+			c.schedule()
+			return
+		}
+		c.flush()
+	})
+}
+
+// replay sends the state of the topic to a new subscriber with send, which
+// reports whether there was any. The interval of the topic then starts over
+// so that the subscriber does not get another message right after. A
+// subscriber joining while a message is pending gets the state with the
+// flush instead of the pending message.
+func (c *conflater) replay(client IClient, send func() bool) {
+	if c.pending {
+		if c.joining == nil {
+			c.joining = make(map[IClient]func() bool)
+		}
+		c.joining[client] = send
+		return
+	}
+
+	if send() {
+		c.restart()
+	}
+}
+
+// restart starts the interval over after a message was sent to a new
+// subscriber. The interval of a pending message is never pushed back, the
+// subscribers joining often would delay it forever.
+func (c *conflater) restart() {
+	if !c.pending {
+		c.last = c.now()
+	}
+}
+
+func (c *conflater) flush() {
+	if !c.pending {
+		return
+	}
+
+	var body interface{} = c.value
+	if c.update != nil {
+		body = c.update
+	}
+	joining := c.joining
+	c.reset()
+	c.last = c.now()
+
+	var skip map[IClient]struct{}
+	if len(joining) > 0 {
+		skip = make(map[IClient]struct{}, len(joining))
+		for client, send := range joining {
+			send()
+			skip[client] = struct{}{}
+		}
+	}
+
+	b, err := packEvent(c.topic.name, body)
+	if err != nil {
+		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
+		return
+	}
+	sendAll(c.topic.clients, outbound{text: string(b), topic: c.topic.name, lane: laneOf(c.topic.scope)}, skip)
+}
+
+// reset drops the pending message, e.g. when a new snapshot is sent to all
+// the subscribers.
+func (c *conflater) reset() {
+	c.pending = false
+	c.value = nil
+	c.update = nil
+	c.joining = nil
+}
+
+func (c *conflater) stop() {
+	c.reset()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
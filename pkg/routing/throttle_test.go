@@ -0,0 +1,231 @@
+package routing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// throttledTopic subscribes the client to a throttled stream and freezes the
+// clock of its conflater, flushes then only depend on the timer.
+func throttledTopic(t *testing.T, h *Hub, c *MockedClient, stream string) (*shard, *Topic) {
+	c.On("SubscribePublic", stream).Return()
+	h.subscribePublic(stream, &Request{client: c})
+
+	s := h.shardFor(message.StreamBase(stream))
+	topic := s.publicTopics[stream]
+	require.NotNil(t, topic.conflater)
+
+	now := time.Now()
+	topic.conflater.now = func() time.Time { return now }
+	return s, topic
+}
+
+// lockedSentMessages reads the messages sent to the client under the lock of
+// the shard, delayed messages are flushed from a timer.
+func lockedSentMessages(s *shard, c *MockedClient) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sentMessages(c)
+}
+
+func TestParseThrottle(t *testing.T) {
+	opts, err := parseStreamOptions("global.tickers@1s")
+	require.NoError(t, err)
+	assert.Equal(t, streamOptions{throttle: time.Second}, opts)
+
+	opts, err = parseStreamOptions("eurusd.ob-inc@20@250ms")
+	require.NoError(t, err)
+	assert.Equal(t, streamOptions{depth: 20, throttle: 250 * time.Millisecond}, opts)
+
+	for _, s := range []string{"global.tickers@1ms", "global.tickers@2m", "global.tickers@-1s", "global.tickers@1x"} {
+		_, err = parseStreamOptions(s)
+		assert.Error(t, err, s)
+	}
+
+	h := NewHub(nil)
+	_, err = h.shardFor("abc.count-inc").newDerivedTopic(h, "abc.count-inc@1s")
+	assert.Error(t, err)
+}
+
+func TestThrottledTickers(t *testing.T) {
+	h := NewHub(nil)
+	c := &MockedClient{}
+	c.On("Send", mock.Anything).Return()
+	s, topic := throttledTopic(t, h, c, "global.tickers@50ms")
+
+	for i := 1; i <= 3; i++ {
+		h.routeMessage(&Event{
+			Scope:  "global",
+			Stream: "global",
+			Type:   "tickers",
+			Topic:  "global.tickers",
+			Body:   map[string]interface{}{"last": i},
+		})
+	}
+
+	// The first message is sent right away, the next ones are conflated
+	require.Eventually(t, func() bool {
+		return len(lockedSentMessages(s, c)) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, []string{
+		`{"global.tickers@50ms":{"last":1}}`,
+		`{"global.tickers@50ms":{"last":3}}`,
+	}, lockedSentMessages(s, c))
+
+	s.mutex.Lock()
+	assert.Nil(t, topic.conflater.timer)
+	s.mutex.Unlock()
+
+	t.Run("throttled streams are removed with their last subscriber", func(t *testing.T) {
+		c.On("GetAuth").Return(Auth{})
+		h.unsubscribeAll(c)
+		assert.Empty(t, s.derived)
+	})
+}
+
+func TestThrottledOrderBook(t *testing.T) {
+	h := NewHub(nil)
+	h.routeMessage(bookEvent("ob-snap", map[string]interface{}{
+		"asks":     [][]string{{"1020.0", "1"}, {"1021.0", "2"}},
+		"bids":     [][]string{{"1000.0", "1"}},
+		"sequence": 10,
+	}))
+
+	c := &MockedClient{}
+	c.On("Send", mock.Anything).Return()
+	s, topic := throttledTopic(t, h, c, "eurusd.ob-inc@50ms")
+
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"asks":     [][]string{{"1020.0", "3"}},
+		"sequence": 11,
+	}))
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"asks":     [][]string{{"1020.0", ""}},
+		"bids":     [][]string{{"1000.0", "2"}},
+		"sequence": 12,
+	}))
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"bids":     [][]string{{"1000.0", "4"}, {"999.0", "1"}},
+		"sequence": 13,
+	}))
+
+	require.Eventually(t, func() bool {
+		return len(lockedSentMessages(s, c)) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	// The snapshot starts the interval, the increments are merged
+	assert.Equal(t, []string{
+		`{"eurusd.ob-snap@50ms":{"asks":[["1020.0","1"],["1021.0","2"]],"bids":[["1000.0","1"]],"sequence":10}}`,
+		`{"eurusd.ob-inc@50ms":{"asks":[["1020.0",""]],"bids":[["1000.0","4"],["999.0","1"]],"sequence":13}}`,
+	}, lockedSentMessages(s, c))
+
+	t.Run("pending increments are dropped on resync", func(t *testing.T) {
+		h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+			"asks":     [][]string{{"1022.0", "1"}},
+			"sequence": 14,
+		}))
+		h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+			"asks":     [][]string{{"1023.0", "1"}},
+			"sequence": 16,
+		}))
+
+		require.Eventually(t, func() bool {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return topic.conflater.timer == nil
+		}, time.Second, 5*time.Millisecond)
+
+		sent := lockedSentMessages(s, c)
+		require.Equal(t, 3, len(sent))
+		assert.Equal(t, `{"resync":{"sequence":14,"stream":"eurusd.ob-inc@50ms"}}`, sent[2])
+	})
+}
+
+func TestThrottledReplay(t *testing.T) {
+	subscriber := func() *MockedClient {
+		c := &MockedClient{}
+		c.On("GetSubscriptions").Return([]string{})
+		c.On("SubscribePublic", mock.Anything).Return()
+		c.On("Send", mock.Anything).Return()
+		return c
+	}
+
+	t.Run("the last value is skipped when a message is pending", func(t *testing.T) {
+		h := NewHub(nil)
+		h.LastValues = NewLastValueCache([]string{"tickers"}, time.Minute)
+		c1 := subscriber()
+		s, _ := throttledTopic(t, h, c1, "global.tickers@50ms")
+
+		for i := 1; i <= 2; i++ {
+			h.routeMessage(&Event{Scope: "global", Stream: "global", Type: "tickers", Topic: "global.tickers", Body: i})
+		}
+
+		c2 := subscriber()
+		h.handleSubscribe(&Request{client: c2, Request: message.Request{Streams: []string{"global.tickers@50ms"}}})
+
+		require.Eventually(t, func() bool {
+			return len(lockedSentMessages(s, c2)) == 2
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, []string{
+			`{"success":{"message":"subscribed","streams":[]}}`,
+			`{"global.tickers@50ms":2}`,
+		}, lockedSentMessages(s, c2))
+		assert.Equal(t, []string{`{"global.tickers@50ms":1}`, `{"global.tickers@50ms":2}`}, lockedSentMessages(s, c1))
+	})
+
+	t.Run("subscribers joining while a message is pending get the snapshot with the flush", func(t *testing.T) {
+		h := NewHub(nil)
+		h.routeMessage(bookEvent("ob-snap", map[string]interface{}{
+			"asks":     [][]string{{"1020.0", "1"}},
+			"sequence": 10,
+		}))
+		c1 := subscriber()
+		s, _ := throttledTopic(t, h, c1, "eurusd.ob-inc@50ms")
+
+		h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+			"asks":     [][]string{{"1021.0", "2"}},
+			"sequence": 11,
+		}))
+		c2 := subscriber()
+		h.subscribePublic("eurusd.ob-inc@50ms", &Request{client: c2})
+		assert.Empty(t, lockedSentMessages(s, c2))
+
+		require.Eventually(t, func() bool {
+			return len(lockedSentMessages(s, c1)) == 2
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, []string{
+			`{"eurusd.ob-snap@50ms":{"asks":[["1020.0","1"]],"bids":[],"sequence":10}}`,
+			`{"eurusd.ob-inc@50ms":{"asks":[["1021.0","2"]],"sequence":11}}`,
+		}, lockedSentMessages(s, c1))
+		assert.Equal(t, []string{
+			`{"eurusd.ob-snap@50ms":{"asks":[["1020.0","1"],["1021.0","2"]],"bids":[],"sequence":11}}`,
+		}, lockedSentMessages(s, c2))
+	})
+}
+
+func TestThrottleUnsupportedStreams(t *testing.T) {
+	h := NewHub(nil)
+	c := &MockedClient{}
+	c.On("GetAuth").Return(Auth{UID: "UID123"})
+	c.On("GetSubscriptions").Return([]string{})
+	c.On("Send", mock.Anything).Return()
+
+	h.handleSubscribe(&Request{
+		client:  c,
+		Request: message.Request{Streams: []string{"abc.count-inc@1s", "order@1s"}},
+	})
+
+	assert.Equal(t, []string{
+		`{"error":"stream abc.count-inc@1s cannot be throttled"}`,
+		`{"error":"stream modifiers are only supported on public streams: order@1s"}`,
+		`{"success":{"message":"subscribed","streams":[]}}`,
+	}, sentMessages(c))
+	assert.Equal(t, 0, publicTopicsCount(h))
+	assert.Equal(t, 0, privateTopicsCount(h))
+}
@@ -1,8 +1,6 @@
 package routing
 
 import (
-	"encoding/json"
-
 	msg "github.com/openware/rango/pkg/message"
 	"github.com/rs/zerolog/log"
 )
@@ -10,6 +8,20 @@ import (
 type Topic struct {
 	hub     *Hub
 	clients map[IClient]struct{}
+
+	// Name and base topic of derived streams, e.g. eurusd.ob-inc@20 derived
+	// from eurusd.ob-inc, both empty for regular topics
+	name string
+	base string
+
+	// Order book view of derived order book streams
+	view *bookView
+
+	// Conflation of the messages of throttled streams
+	conflater *conflater
+
+	// Scope of private and prefixed topics, empty for public ones
+	scope string
 }
 
 func NewTopic(h *Hub) *Topic {
@@ -28,6 +40,11 @@ func eventMust(method string, data interface{}) []byte {
 	return ev
 }
 
+// packEvent returns the {topic: body} message of an event.
+func packEvent(topic string, body interface{}) ([]byte, error) {
+	return msg.PackOutgoingEvent(topic, body)
+}
+
 func contains(list []string, el string) bool {
 	for _, l := range list {
 		if l == el {
@@ -41,25 +58,66 @@ func (t *Topic) len() int {
 	return len(t.clients)
 }
 
+// broadcast sends the event to the subscribers, the message is built once
+// and shared by all of them.
 func (t *Topic) broadcast(message *Event) {
-	body, err := json.Marshal(map[string]interface{}{
-		message.Topic: message.Body,
-	})
-
+	body, err := packEvent(message.Topic, message.Body)
 	if err != nil {
 		log.Error().Msgf("Fail to JSON marshal: %s", err.Error())
 		return
 	}
 
-	for client := range t.clients {
-		client.Send(string(body))
+	t.broadcastRaw(message.Topic, string(body))
+}
+
+// broadcastRaw sends a message of the topic to the subscribers, the topic is
+// empty for the messages which must not be dropped by the slow consumer
+// policy, like resync requests.
+func (t *Topic) broadcastRaw(topic, msgBody string) {
+	sendAll(t.clients, outbound{text: msgBody, topic: topic, lane: laneOf(t.scope)}, nil)
+}
+
+// sendAll sends the message to the clients but the skipped ones. The
+// websocket frame is prepared once for all the connections.
+func sendAll(clients map[IClient]struct{}, m outbound, skip map[IClient]struct{}) {
+	for client := range clients {
+		if _, ok := skip[client]; ok {
+			continue
+		}
+		send(client, &m)
 	}
 }
 
-func (t *Topic) broadcastRaw(msgBody string) {
-	for client := range t.clients {
-		client.Send(msgBody)
+// send sends the message to a client, the websocket frame is prepared on
+// first use and shared with the next clients.
+func send(client IClient, m *outbound) {
+	c, ok := client.(eventSender)
+	if !ok {
+		client.Send(m.text)
+		return
+	}
+
+	if m.prepared == nil {
+		m.prepared = newPreparedMessage(m.text)
+	}
+	c.sendEvent(*m)
+}
+
+// sendTopic sends a message replaying the state of a topic to a client, in
+// the lane of the live messages of the topic so that it is written before
+// them. The topic is the name of the message, the slow consumer policy
+// drops replayed messages like live ones.
+func sendTopic(c IClient, scope, topic, message string) {
+	if s, ok := c.(eventSender); ok {
+		s.sendEvent(outbound{text: message, topic: topic, lane: laneOf(scope)})
+		return
 	}
+	c.Send(message)
+}
+
+func (t *Topic) has(c IClient) bool {
+	_, ok := t.clients[c]
+	return ok
 }
 
 func (t *Topic) subscribe(c IClient) bool {
@@ -74,6 +132,9 @@ func (t *Topic) subscribe(c IClient) bool {
 func (t *Topic) unsubscribe(c IClient) bool {
 	_, ok := t.clients[c]
 	delete(t.clients, c)
+	if t.conflater != nil {
+		delete(t.conflater.joining, c)
+	}
 
 	return ok
 }
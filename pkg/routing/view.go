@@ -0,0 +1,335 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	msg "github.com/openware/rango/pkg/message"
+	"github.com/openware/rango/pkg/orderbook"
+	"github.com/rs/zerolog/log"
+)
+
+// Maximum number of levels of a depth limited order book stream.
+var maxViewDepth = 1000
+
+// streamOptions are the modifiers following a stream name, for example
+// eurusd.ob-inc@20 is the stream of the 20 best levels of the eurusd book,
+// eurusd.ob-inc#0.1 the book with price levels grouped by 0.1 and
+// global.tickers@1s the tickers conflated to at most one message per second.
+type streamOptions struct {
+	depth    int
+	tick     string
+	throttle time.Duration
+}
+
+// bookView is an order book stream derived from the full book of its base
+// topic. It keeps the levels last sent to its subscribers to compute the
+// increments of the view, except for views of the full book which forward
+// the increments of the base topic.
+type bookView struct {
+	base    string
+	name    string
+	options streamOptions
+
+	// Book of the aggregated levels for grouped streams
+	grouping *orderbook.Grouping
+	grouped  *orderbook.Book
+
+	asks  []orderbook.Level
+	bids  []orderbook.Level
+	ready bool
+}
+
+func parseStreamOptions(stream string) (streamOptions, error) {
+	opts := streamOptions{}
+	mods := stream[len(msg.StreamBase(stream)):]
+
+	for mods != "" {
+		end := strings.IndexAny(mods[1:], "@#") + 1
+		if end == 0 {
+			end = len(mods)
+		}
+		mod, value := mods[0], mods[1:end]
+		mods = mods[end:]
+
+		switch mod {
+		case '@':
+			if depth, err := strconv.Atoi(value); err == nil {
+				if depth <= 0 || depth > maxViewDepth {
+					return opts, fmt.Errorf("invalid depth %q in stream %s", value, stream)
+				}
+				opts.depth = depth
+				continue
+			}
+
+			throttle, err := time.ParseDuration(value)
+			if err != nil || throttle < minThrottle || throttle > maxThrottle {
+				return opts, fmt.Errorf("invalid depth or throttle %q in stream %s", value, stream)
+			}
+			opts.throttle = throttle
+
+		case '#':
+			if _, err := orderbook.NewGrouping(value); err != nil {
+				return opts, fmt.Errorf("invalid tick size %q in stream %s", value, stream)
+			}
+			opts.tick = value
+
+		default:
+			return opts, fmt.Errorf("unsupported modifier %q in stream %s", string(mod), stream)
+		}
+	}
+
+	return opts, nil
+}
+
+// newDerivedTopic returns the topic of a stream with modifiers, or nil if the
+// stream has none. Depth and tick size only apply to order book streams, any
+// other stream can be throttled unless it is incremental.
+func (s *shard) newDerivedTopic(h *Hub, stream string) (*Topic, error) {
+	base := msg.StreamBase(stream)
+	if base == stream {
+		return nil, nil
+	}
+
+	opts, err := parseStreamOptions(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := NewTopic(h)
+	topic.name = stream
+	topic.base = base
+
+	switch {
+	case strings.HasSuffix(base, ".ob-inc"):
+		topic.view = &bookView{
+			base:    base,
+			name:    stream,
+			options: opts,
+		}
+		if opts.tick != "" {
+			topic.view.grouping, err = orderbook.NewGrouping(opts.tick)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case opts.depth != 0 || opts.tick != "":
+		return nil, fmt.Errorf("stream %s is not an order book stream", stream)
+
+	case isIncrementObject(base):
+		return nil, fmt.Errorf("stream %s cannot be throttled", stream)
+	}
+
+	if opts.throttle != 0 {
+		topic.conflater = newConflater(topic, &s.mutex, opts.throttle)
+	}
+
+	return topic, nil
+}
+
+// full reports whether the view is the whole book, only throttled.
+func (v *bookView) full() bool {
+	return v.options.depth == 0 && v.grouping == nil
+}
+
+// levels returns the levels of the view, from the grouped book for grouped
+// streams.
+func (v *bookView) levels(book *orderbook.Book) ([]orderbook.Level, []orderbook.Level) {
+	if v.grouped != nil {
+		book = v.grouped
+	}
+
+	depth := v.options.depth
+	if depth == 0 {
+		return book.Asks.Top(book.Asks.Len()), book.Bids.Top(book.Bids.Len())
+	}
+	return book.Asks.Top(depth), book.Bids.Top(depth)
+}
+
+// reset loads the view from the book.
+func (v *bookView) reset(book *orderbook.Book) {
+	v.ready = true
+	if v.full() {
+		return
+	}
+
+	if v.grouping != nil {
+		v.grouped = v.grouping.Group(book)
+	}
+	v.asks, v.bids = v.levels(book)
+}
+
+func (v *bookView) snapshotMessage(o *IncrementalObject) string {
+	asks, bids := v.levels(o.Book)
+	u := &orderbook.Update{
+		Asks:     orderbook.Pairs(asks),
+		Bids:     orderbook.Pairs(bids),
+		Sequence: o.Book.Sequence,
+	}
+
+	body, err := u.MarshalSnapshot()
+	if err != nil {
+		log.Error().Msgf("Failed to marshal view %s: %s", v.name, err.Error())
+		return ""
+	}
+
+	return string(eventMust(v.snapshotTopic(o), json.RawMessage(body)))
+}
+
+// snapshotTopic returns the name of the snapshots of the view, e.g.
+// eurusd.ob-snap@20.
+func (v *bookView) snapshotTopic(o *IncrementalObject) string {
+	return o.SnapshotTopic + v.name[len(v.base):]
+}
+
+// update applies the changes of the book to the view and returns the
+// increment to send to the subscribers, if any of the visible levels changed.
+// The increment u applied to the book limits the buckets to regroup, all of
+// them are recomputed when it is nil.
+func (v *bookView) update(book *orderbook.Book, u *orderbook.Update) (*orderbook.Update, bool) {
+	if v.full() {
+		return u, u != nil
+	}
+
+	if v.grouping != nil {
+		if u != nil {
+			v.grouping.Regroup(v.grouped, book, u)
+		} else {
+			v.grouped = v.grouping.Group(book)
+		}
+	}
+
+	asks, bids := v.levels(book)
+	inc := &orderbook.Update{
+		Asks:     orderbook.Diff(v.asks, asks),
+		Bids:     orderbook.Diff(v.bids, bids),
+		Sequence: book.Sequence,
+	}
+	v.asks, v.bids = asks, bids
+
+	if len(inc.Asks) == 0 && len(inc.Bids) == 0 {
+		return nil, false
+	}
+
+	return inc, true
+}
+
+// replay sends the current state of the view to a new subscriber and
+// reports whether the book had one.
+func (v *bookView) replay(o *IncrementalObject, c IClient) bool {
+	if o == nil || o.Book == nil || o.Stale {
+		return false
+	}
+
+	if !v.ready {
+		v.reset(o.Book)
+	}
+	sendTopic(c, "", v.snapshotTopic(o), v.snapshotMessage(o))
+	return true
+}
+
+// sendIncrement sends an increment of the view, merged with the pending one
+// for throttled streams.
+func (t *Topic) sendIncrement(inc *orderbook.Update) {
+	if t.conflater != nil {
+		t.conflater.merge(inc)
+		return
+	}
+	t.broadcastRaw(t.name, string(eventMust(t.name, inc)))
+}
+
+// sendSnapshot sends a message replacing the state of the stream, increments
+// still pending are dropped.
+func (t *Topic) sendSnapshot(msg string) {
+	if t.conflater != nil {
+		t.conflater.reset()
+	}
+	t.broadcastRaw(t.name, msg)
+}
+
+func (s *shard) addDerived(topic *Topic) {
+	derived, ok := s.derived[topic.base]
+	if !ok {
+		derived = make(map[string]*Topic, 1)
+		s.derived[topic.base] = derived
+	}
+	derived[topic.name] = topic
+}
+
+func (s *shard) deletePublicTopic(t string, topic *Topic) {
+	delete(s.publicTopics, t)
+
+	if topic.base == "" {
+		return
+	}
+
+	if topic.conflater != nil {
+		topic.conflater.stop()
+	}
+
+	derived := s.derived[topic.base]
+	delete(derived, t)
+	if len(derived) == 0 {
+		delete(s.derived, topic.base)
+	}
+}
+
+// updateDerived sends a message of the base topic to the subscribers of its
+// throttled streams.
+func (s *shard) updateDerived(msg *Event) {
+	for _, topic := range s.derived[msg.Topic] {
+		if topic.conflater != nil {
+			topic.conflater.push(msg.Body)
+		}
+	}
+}
+
+// updateViews sends the changes of the book of the base topic to the
+// subscribers of its views after a snapshot or an increment.
+func (s *shard) updateViews(msg *Event) {
+	views, ok := s.derived[msg.Topic]
+	if !ok {
+		return
+	}
+
+	o, ok := s.incrementalObjects[msg.Topic]
+	if !ok || o.Book == nil || o.Stale {
+		return
+	}
+
+	var u *orderbook.Update
+	if isIncrementObject(msg.Type) {
+		u, _ = msg.orderBookUpdate()
+	}
+
+	for _, topic := range views {
+		v := topic.view
+		if !v.ready {
+			v.reset(o.Book)
+			topic.sendSnapshot(v.snapshotMessage(o))
+			continue
+		}
+
+		if inc, ok := v.update(o.Book, u); ok {
+			topic.sendIncrement(inc)
+		}
+	}
+}
+
+// resyncViews notifies the subscribers of the views that the base topic is
+// stale, they receive a new snapshot once the book is recovered.
+func (s *shard) resyncViews(base string) {
+	o, ok := s.incrementalObjects[base]
+	if !ok {
+		return
+	}
+
+	for _, topic := range s.derived[base] {
+		topic.view.ready = false
+		topic.sendSnapshot(resyncMessage(o, topic.view.name))
+	}
+}
@@ -0,0 +1,165 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/openware/rango/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func bookEvent(typ string, body map[string]interface{}) *Event {
+	return &Event{
+		Scope:  "public",
+		Stream: "eurusd",
+		Type:   typ,
+		Topic:  "eurusd.ob-inc",
+		Body:   body,
+	}
+}
+
+func TestParseStreamOptions(t *testing.T) {
+	opts, err := parseStreamOptions("eurusd.ob-inc@20")
+	require.NoError(t, err)
+	assert.Equal(t, 20, opts.depth)
+
+	opts, err = parseStreamOptions("eurusd.ob-inc#0.1@20")
+	require.NoError(t, err)
+	assert.Equal(t, streamOptions{depth: 20, tick: "0.1"}, opts)
+
+	for _, s := range []string{"eurusd.ob-inc@", "eurusd.ob-inc@0", "eurusd.ob-inc@abc", "eurusd.ob-inc@100000", "eurusd.ob-inc#0", "eurusd.ob-inc#", "eurusd.ob-inc#1e3"} {
+		_, err = parseStreamOptions(s)
+		assert.Error(t, err, s)
+	}
+
+	h := NewHub(nil)
+	s := h.shardFor("eurusd.ob-inc")
+	topic, err := s.newDerivedTopic(h, "eurusd.ob-inc")
+	require.NoError(t, err)
+	assert.Nil(t, topic)
+
+	_, err = s.newDerivedTopic(h, "eurusd.trades@20")
+	assert.Error(t, err)
+}
+
+func TestDepthLimitedView(t *testing.T) {
+	h := NewHub(nil)
+	h.routeMessage(bookEvent("ob-snap", map[string]interface{}{
+		"asks":     [][]string{{"1020.0", "1"}, {"1021.0", "2"}, {"1022.0", "3"}},
+		"bids":     [][]string{{"1000.0", "1"}, {"999.0", "2"}, {"998.0", "3"}},
+		"sequence": 10,
+	}))
+
+	c := &MockedClient{}
+	c.On("GetAuth").Return(Auth{})
+	c.On("GetSubscriptions").Return([]string{"eurusd.ob-inc@2"})
+	c.On("SubscribePublic", "eurusd.ob-inc@2").Return()
+	c.On("Send", mock.Anything).Return()
+	h.handleSubscribe(&Request{
+		client:  c,
+		Request: message.Request{Streams: []string{"eurusd.ob-inc@2"}},
+	})
+
+	// Out of the view
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"asks":     [][]string{{"1022.0", "4"}},
+		"sequence": 11,
+	}))
+	// Best bid removed, the third one moves into view
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"bids":     [][]string{{"1000.0", ""}},
+		"sequence": 12,
+	}))
+	// Better ask pushes the second level out of the view
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"asks":     [][]string{{"1019.0", "5"}},
+		"sequence": 13,
+	}))
+
+	assert.Equal(t, []string{
+		`{"eurusd.ob-snap@2":{"asks":[["1020.0","1"],["1021.0","2"]],"bids":[["1000.0","1"],["999.0","2"]],"sequence":10}}`,
+		`{"success":{"message":"subscribed","streams":["eurusd.ob-inc@2"]}}`,
+		`{"eurusd.ob-inc@2":{"bids":[["998.0","3"],["1000.0",""]],"sequence":12}}`,
+		`{"eurusd.ob-inc@2":{"asks":[["1019.0","5"],["1021.0",""]],"sequence":13}}`,
+	}, sentMessages(c))
+
+	t.Run("new subscriber receives the current view", func(t *testing.T) {
+		c := &MockedClient{}
+		c.On("SubscribePublic", "eurusd.ob-inc@2").Return()
+		c.On("Send", `{"eurusd.ob-snap@2":{"asks":[["1019.0","5"],["1020.0","1"]],"bids":[["999.0","2"],["998.0","3"]],"sequence":13}}`).Return().Once()
+		h.subscribePublic("eurusd.ob-inc@2", &Request{client: c})
+		c.AssertExpectations(t)
+	})
+
+	t.Run("views are removed with their last subscriber", func(t *testing.T) {
+		h.unsubscribeAll(c)
+		require.Equal(t, 1, len(h.shardFor("eurusd.ob-inc").derived["eurusd.ob-inc"]))
+	})
+}
+
+func TestViewBeforeSnapshotAndResync(t *testing.T) {
+	h := NewHub(nil)
+
+	c := &MockedClient{}
+	c.On("SubscribePublic", "eurusd.ob-inc@1").Return()
+	c.On("Send", mock.Anything).Return()
+	h.subscribePublic("eurusd.ob-inc@1", &Request{client: c})
+	require.Empty(t, sentMessages(c))
+
+	h.routeMessage(bookEvent("ob-snap", map[string]interface{}{
+		"asks":     [][]string{{"1020.0", "1"}},
+		"sequence": 10,
+	}))
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"asks":     [][]string{{"1020.0", "2"}},
+		"sequence": 12,
+	}))
+	h.routeMessage(bookEvent("ob-snap", map[string]interface{}{
+		"asks":     [][]string{{"1020.0", "3"}},
+		"sequence": 12,
+	}))
+
+	assert.Equal(t, []string{
+		`{"eurusd.ob-snap@1":{"asks":[["1020.0","1"]],"bids":[],"sequence":10}}`,
+		`{"resync":{"sequence":10,"stream":"eurusd.ob-inc@1"}}`,
+		`{"eurusd.ob-snap@1":{"asks":[["1020.0","3"]],"bids":[],"sequence":12}}`,
+	}, sentMessages(c))
+}
+
+func TestGroupedView(t *testing.T) {
+	h := NewHub(nil)
+	h.routeMessage(bookEvent("ob-snap", map[string]interface{}{
+		"asks":     [][]string{{"1020.5", "1"}, {"1021.0", "2"}, {"1022.5", "3"}},
+		"bids":     [][]string{{"1000.5", "1"}, {"1000.0", "2"}, {"998.5", "3"}},
+		"sequence": 10,
+	}))
+
+	c := &MockedClient{}
+	c.On("SubscribePublic", "eurusd.ob-inc#1.0").Return()
+	c.On("SubscribePublic", "eurusd.ob-inc#1.0@1").Return()
+	c.On("Send", mock.Anything).Return()
+	h.subscribePublic("eurusd.ob-inc#1.0", &Request{client: c})
+	h.subscribePublic("eurusd.ob-inc#1.0@1", &Request{client: c})
+
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"asks":     [][]string{{"1020.5", ""}, {"1020.8", "0.5"}},
+		"bids":     [][]string{{"1000.0", "1"}},
+		"sequence": 11,
+	}))
+	h.routeMessage(bookEvent("ob-inc", map[string]interface{}{
+		"asks":     [][]string{{"1020.8", ""}},
+		"sequence": 12,
+	}))
+
+	sent := sentMessages(c)
+	require.Equal(t, 6, len(sent))
+	assert.Equal(t, `{"eurusd.ob-snap#1.0":{"asks":[["1021.0","3"],["1023.0","3"]],"bids":[["1000.0","3"],["998.0","3"]],"sequence":10}}`, sent[0])
+	assert.Equal(t, `{"eurusd.ob-snap#1.0@1":{"asks":[["1021.0","3"]],"bids":[["1000.0","3"]],"sequence":10}}`, sent[1])
+	assert.ElementsMatch(t, []string{
+		`{"eurusd.ob-inc#1.0":{"asks":[["1021.0","2.5"]],"bids":[["1000.0","2"]],"sequence":11}}`,
+		`{"eurusd.ob-inc#1.0@1":{"asks":[["1021.0","2.5"]],"bids":[["1000.0","2"]],"sequence":11}}`,
+		`{"eurusd.ob-inc#1.0":{"asks":[["1021.0","2"]],"sequence":12}}`,
+		`{"eurusd.ob-inc#1.0@1":{"asks":[["1021.0","2"]],"sequence":12}}`,
+	}, sent[2:])
+}